@@ -3,42 +3,270 @@ package main
 import (
 	"context"
 	"errors"
+	"slices"
+	"time"
 
 	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/jwt"
 	"github.com/saarwasserman/auth/internal/validator"
 	"github.com/saarwasserman/auth/protogen/auth"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// Login states tell clients whether they got a session or what they have to
+// do first.
+const (
+	loginStateAuthenticated   = "authenticated"
+	loginStatePasswordExpired = "password_expired"
+	loginStateMfaPending      = "mfa_pending"
+)
+
 func (app *application) isValidAuthenticationToken(token_scope, token_plaintext string) (*data.Token, error) {
+	if app.config.jwt.enabled && token_scope == data.ScopeAuthentication && jwt.LooksLikeJWT(token_plaintext) {
+		token, err := app.verifyAccessJWT(token_plaintext)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, "invalid auth token")
+		}
+
+		return token, nil
+	}
+
+	scope, err := app.models.Tokens.Scope(token_scope)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid auth token")
+	}
+
 	v := validator.New()
 
-	if data.ValidateTokenPlaintext(v, token_plaintext); !v.Valid() {
+	if data.ValidateTokenPlaintext(v, token_plaintext, scope.PlaintextLength()); !v.Valid() {
 		return nil, status.Error(codes.Unauthenticated, "invalid auth token")
 	}
 
-	token, err := app.models.Tokens.GetForToken(token_scope, token_plaintext)
+	var token *data.Token
+	if scope.SingleUse {
+		token, err = app.models.Tokens.Consume(token_scope, token_plaintext)
+	} else {
+		token, err = app.models.Tokens.GetForToken(token_scope, token_plaintext)
+	}
+
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrTokenReused):
 			return nil, status.Error(codes.Unauthenticated, "invalid auth token")
 		default:
 			return nil, status.Error(codes.Unauthenticated, err.Error())
 		}
 	}
 
+	if token.Scope == data.ScopeAuthentication {
+		err = app.checkSessionActivity(token)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return token, nil
 }
 
+// accessScopes are the scopes whose tokens Authenticate vouches for. Other
+// tokens are only good for the methods that take them, and checking a
+// single-use one would spend it.
+var accessScopes = []string{data.ScopeAuthentication, data.ScopeAPIKey}
+
+// Authenticate lets other services check an access token. It never consumes
+// the token.
 func (app *application) Authenticate(ctx context.Context, req *auth.AuthenticationRequest) (*auth.AuthenticationResponse, error) {
+	if !slices.Contains(accessScopes, req.TokenScope) {
+		return nil, status.Error(codes.InvalidArgument, "only access tokens can be authenticated")
+	}
+
 	token, err := app.isValidAuthenticationToken(req.TokenScope, req.TokenPlaintext)
 	if err != nil {
 		app.logger.PrintError(err, nil)
 		return nil, err
 	}
 
+	var authTime int64
+	if !token.AuthTime.IsZero() {
+		authTime = token.AuthTime.Unix()
+	}
+
+	// services enforce their own step-up policies with these
 	return &auth.AuthenticationResponse{
-		UserId: token.UserID,
+		UserId:   token.UserID,
+		Acr:      authenticationACR(token.AuthMethods),
+		Amr:      token.AuthMethods,
+		AuthTime: authTime,
 	}, nil
 }
+
+func (app *application) Login(ctx context.Context, req *auth.LoginRequest) (*auth.LoginResponse, error) {
+	v := validator.New()
+
+	data.ValidateEmail(v, req.Email)
+	v.Check(req.Password != "", "password", "must be provided")
+
+	if !v.Valid() {
+		return nil, status.Error(codes.InvalidArgument, "invalid login request")
+	}
+
+	// an unknown email falls through with an id that has no credentials, so the
+	// password check below still runs and both failures look and cost the same
+	var userId int64 = -1
+	activated := false
+
+	user, err := app.models.Users.GetByEmail(req.Email)
+	switch {
+	case err == nil:
+		userId = user.ID
+		activated = user.Activated
+	case !errors.Is(err, data.ErrRecordNotFound):
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	accountKey := accountAttemptKey(userId, req.Email)
+	ipKey := app.ipAttemptKey(ctx)
+
+	attempt, err := app.beginAttempt(accountKey, ipKey)
+	if err != nil {
+		return nil, err
+	}
+	defer attempt.end()
+
+	match, needsRehash, err := app.models.Passwords.Matches(ctx, userId, req.Password)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !match {
+		attempt.fail()
+
+		if attempt.locked(accountKey) && user != nil {
+			app.sendEmail(user.Email, "account_locked.tmpl", map[string]string{
+				"name":        user.Name,
+				"lockedUntil": time.Now().Add(app.config.lockout.lockDuration).Format(time.RFC1123),
+			})
+		}
+
+		return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+	}
+
+	attempt.succeed(accountKey)
+
+	if needsRehash {
+		app.rehashPassword(ctx, userId, req.Password)
+	}
+
+	if !activated {
+		return nil, status.Error(codes.PermissionDenied, "user account must be activated")
+	}
+
+	expired, err := app.passwordExpired(ctx, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if expired {
+		mfaEnabled, err := app.models.Totp.Enabled(ctx, userId)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		// users with TOTP prove the second factor first, and VerifyTotp
+		// hands out the password-change token
+		if !mfaEnabled {
+			return app.passwordChangeLogin(userId)
+		}
+	}
+
+	return app.completeLogin(ctx, userId, req.Client, req.UserAgent, data.AuthMethodPassword)
+}
+
+// completeLogin finishes a login with a first factor, the given
+// authentication method: it starts a session, or, for users with TOTP
+// enabled, issues the mfa-pending token that VerifyTotp exchanges for one.
+func (app *application) completeLogin(ctx context.Context, userId int64, client, userAgent, method string) (*auth.LoginResponse, error) {
+	mfaEnabled, err := app.models.Totp.Enabled(ctx, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if mfaEnabled {
+		// the session waits for the second factor, see VerifyTotp. The
+		// token remembers the first one for it.
+		pending, err := data.NewSession(client, userAgent)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		pending.AuthMethods = []string{method}
+		pending.AuthTime = pending.CreatedAt
+
+		token, err := app.models.Tokens.NewForSession(userId, app.tokenTTL(data.ScopeMfaPending, 0), data.ScopeMfaPending, pending)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		return &auth.LoginResponse{
+			UserId:         userId,
+			TokenPlaintext: token.Plaintext,
+			Expiry:         token.Expiry.UnixMilli(),
+			State:          loginStateMfaPending,
+		}, nil
+	}
+
+	accessToken, refreshToken, err := app.startSession(userId, client, userAgent, []string{method}, 0)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.LoginResponse{
+		UserId:                userId,
+		TokenPlaintext:        accessToken.Plaintext,
+		Expiry:                accessToken.Expiry.UnixMilli(),
+		RefreshTokenPlaintext: refreshToken.Plaintext,
+		RefreshExpiry:         refreshToken.Expiry.UnixMilli(),
+		SessionId:             accessToken.SessionID,
+		State:                 loginStateAuthenticated,
+	}, nil
+}
+
+// passwordChangeLogin answers a login with an expired password: no session
+// until the password is changed, only a token that ChangePassword accepts.
+func (app *application) passwordChangeLogin(userId int64) (*auth.LoginResponse, error) {
+	token, err := app.models.Tokens.New(userId, app.tokenTTL(data.ScopePasswordChange, 0), data.ScopePasswordChange)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.LoginResponse{
+		UserId:         userId,
+		TokenPlaintext: token.Plaintext,
+		Expiry:         token.Expiry.UnixMilli(),
+		State:          loginStatePasswordExpired,
+	}, nil
+}
+
+// passwordExpired reports whether the user's password is older than the
+// configured maximum age.
+func (app *application) passwordExpired(ctx context.Context, userId int64) (bool, error) {
+	if app.config.password.maxAge <= 0 {
+		return false, nil
+	}
+
+	changedAt, err := app.models.Passwords.ChangedAt(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+
+	return time.Since(changedAt) > app.config.password.maxAge, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/breach"
+	"github.com/saarwasserman/auth/internal/validator"
+)
+
+// buildBreachIndex implements the build-breach-index subcommand, which turns
+// a Pwned Passwords SHA-1 dump into the index read by -password-breach-index.
+func buildBreachIndex(args []string) error {
+	fs := flag.NewFlagSet("build-breach-index", flag.ExitOnError)
+
+	in := fs.String("in", "", "Pwned Passwords SHA-1 dump sorted by hash (HASH:COUNT per line)")
+	out := fs.String("out", "", "Index file to write")
+	minCount := fs.Int("min-count", 1, "Leave out hashes seen fewer times than this")
+
+	fs.Parse(args)
+
+	if *in == "" || *out == "" {
+		fs.Usage()
+		return errors.New("-in and -out must be provided")
+	}
+
+	src, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// the index is built next to its destination and only replaces it once
+	// complete, so a running service never opens a partial index
+	dst, err := os.CreateTemp(filepath.Dir(*out), ".breach-index-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	start := time.Now()
+
+	count, err := breach.Build(dst, src, *minCount)
+	if err != nil {
+		return err
+	}
+
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(dst.Name(), *out); err != nil {
+		return err
+	}
+
+	fmt.Printf("indexed %d hashes in %s\n", count, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// checkBreachedPassword rejects a new password found in the breach index,
+// when one is configured.
+func (app *application) checkBreachedPassword(v *validator.Validator, key, plaintextPassword string) error {
+	if app.breachIndex == nil {
+		return nil
+	}
+
+	breached, err := app.breachIndex.Contains(plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	v.Check(!breached, key+".breached", "has appeared in a data breach")
+	return nil
+}
@@ -6,18 +6,65 @@ import (
 
 type ContextKey string
 
-const userIdContextKey = ContextKey("userId")
+const (
+	userIdContextKey      = ContextKey("userId")
+	sessionIdContextKey   = ContextKey("sessionId")
+	scopeContextKey       = ContextKey("scope")
+	authMethodsContextKey = ContextKey("authMethods")
+)
 
 func (app *application) contextSetUserId(ctx context.Context, userId int64) context.Context {
 	ctx = context.WithValue(ctx, userIdContextKey, userId)
 	return ctx
 }
 
-// func (app *application) contextGetUserId(ctx context.Context) int64 {
-// 	userId, ok := ctx.Value(userIdContextKey).(int64)
-// 	if !ok {
-// 		panic("missing userId value in request context")
-// 	}
+func (app *application) contextGetUserId(ctx context.Context) int64 {
+	userId, ok := ctx.Value(userIdContextKey).(int64)
+	if !ok {
+		panic("missing userId value in request context")
+	}
+
+	return userId
+}
+
+func (app *application) contextSetSessionId(ctx context.Context, sessionId string) context.Context {
+	ctx = context.WithValue(ctx, sessionIdContextKey, sessionId)
+	return ctx
+}
+
+func (app *application) contextGetSessionId(ctx context.Context) string {
+	sessionId, ok := ctx.Value(sessionIdContextKey).(string)
+	if !ok {
+		panic("missing sessionId value in request context")
+	}
+
+	return sessionId
+}
+
+func (app *application) contextSetScope(ctx context.Context, scope string) context.Context {
+	ctx = context.WithValue(ctx, scopeContextKey, scope)
+	return ctx
+}
+
+func (app *application) contextGetScope(ctx context.Context) string {
+	scope, ok := ctx.Value(scopeContextKey).(string)
+	if !ok {
+		panic("missing scope value in request context")
+	}
+
+	return scope
+}
+
+func (app *application) contextSetAuthMethods(ctx context.Context, methods []string) context.Context {
+	ctx = context.WithValue(ctx, authMethodsContextKey, methods)
+	return ctx
+}
+
+func (app *application) contextGetAuthMethods(ctx context.Context) []string {
+	methods, ok := ctx.Value(authMethodsContextKey).([]string)
+	if !ok {
+		panic("missing authMethods value in request context")
+	}
 
-// 	return userId
-// }
+	return methods
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/saarwasserman/auth/internal/validator"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (app *application) writeJSON(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(payload)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// failedValidationError returns an InvalidArgument error that carries every
+// validation error as a BadRequest field violation.
+func (app *application) failedValidationError(message string, v *validator.Validator) error {
+	badRequest := &errdetails.BadRequest{}
+
+	fields := make([]string, 0, len(v.Errors))
+	for field := range v.Errors {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+
+	for _, field := range fields {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       field,
+			Description: v.Errors[field],
+		})
+	}
+
+	st, err := status.New(codes.InvalidArgument, message).WithDetails(badRequest)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.InvalidArgument, message)
+	}
+
+	return st.Err()
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	interceptorsAuth "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/jwt"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// introspection is a token introspection response as defined by RFC 7662.
+// Inactive tokens carry no other member.
+type introspection struct {
+	Active      bool     `json:"active"`
+	Subject     string   `json:"sub,omitempty"`
+	Scope       string   `json:"scope,omitempty"`
+	Expiry      int64    `json:"exp,omitempty"`
+	IssuedAt    int64    `json:"iat,omitempty"`
+	ClientID    string   `json:"client_id,omitempty"`
+	TokenType   string   `json:"token_type,omitempty"`
+	SessionID   string   `json:"sid,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	ACR         string   `json:"acr,omitempty"`
+	AuthMethods []string `json:"amr,omitempty"`
+	AuthTime    int64    `json:"auth_time,omitempty"`
+}
+
+// introspect describes the token without consuming it. Any token that cannot
+// be used right now, for whatever reason, is reported as inactive.
+func (app *application) introspect(tokenPlaintext string) (*introspection, error) {
+	var token *data.Token
+	var err error
+
+	if app.config.jwt.enabled && jwt.LooksLikeJWT(tokenPlaintext) {
+		token, err = app.verifyAccessJWT(tokenPlaintext)
+		if err != nil {
+			return &introspection{Active: false}, nil
+		}
+	} else {
+		token, err = app.models.Tokens.GetForPlaintext(tokenPlaintext)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				return &introspection{Active: false}, nil
+			default:
+				return nil, err
+			}
+		}
+
+		if token.Scope == data.ScopeAuthentication && app.checkSessionActivity(token) != nil {
+			return &introspection{Active: false}, nil
+		}
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(token.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	var authTime int64
+	if !token.AuthTime.IsZero() {
+		authTime = token.AuthTime.Unix()
+	}
+
+	return &introspection{
+		Active:      true,
+		Subject:     strconv.FormatInt(token.UserID, 10),
+		Scope:       token.Scope,
+		Expiry:      token.Expiry.Unix(),
+		IssuedAt:    token.CreatedAt.Unix(),
+		ClientID:    token.Client,
+		TokenType:   "Bearer",
+		SessionID:   token.SessionID,
+		Permissions: permissions,
+		ACR:         authenticationACR(token.AuthMethods),
+		AuthMethods: token.AuthMethods,
+		AuthTime:    authTime,
+	}, nil
+}
+
+// introspectionClientValid reports whether the credentials are those of the
+// introspection client. Without a configured secret no client is.
+func (app *application) introspectionClientValid(clientId, clientSecret string) bool {
+	if app.config.introspection.clientSecret == "" {
+		return false
+	}
+
+	idMatch := subtle.ConstantTimeCompare([]byte(clientId), []byte(app.config.introspection.clientId)) == 1
+	secretMatch := subtle.ConstantTimeCompare([]byte(clientSecret), []byte(app.config.introspection.clientSecret)) == 1
+
+	return idMatch && secretMatch
+}
+
+// IntrospectToken is the gRPC counterpart of introspectHandler. Callers
+// authenticate as the introspection client with basic credentials in the
+// authorization metadata.
+func (app *application) IntrospectToken(ctx context.Context, req *auth.IntrospectTokenRequest) (*auth.IntrospectTokenResponse, error) {
+	if app.config.introspection.clientSecret == "" {
+		return nil, status.Error(codes.FailedPrecondition, "token introspection is not enabled")
+	}
+
+	credentials, err := interceptorsAuth.AuthFromMD(ctx, "basic")
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "missing client credentials")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(credentials)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "invalid client credentials")
+	}
+
+	clientId, clientSecret, ok := strings.Cut(string(decoded), ":")
+	if !ok || !app.introspectionClientValid(clientId, clientSecret) {
+		return nil, status.Error(codes.Unauthenticated, "invalid client credentials")
+	}
+
+	if req.TokenPlaintext == "" {
+		return nil, status.Error(codes.InvalidArgument, "token must be provided")
+	}
+
+	result, err := app.introspect(req.TokenPlaintext)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.IntrospectTokenResponse{
+		Active:      result.Active,
+		Sub:         result.Subject,
+		Scope:       result.Scope,
+		Exp:         result.Expiry,
+		Iat:         result.IssuedAt,
+		ClientId:    result.ClientID,
+		TokenType:   result.TokenType,
+		SessionId:   result.SessionID,
+		Permissions: result.Permissions,
+		Acr:         result.ACR,
+		Amr:         result.AuthMethods,
+		AuthTime:    result.AuthTime,
+	}, nil
+}
+
+// introspectHandler serves RFC 7662 introspection requests. Callers must
+// present the introspection client credentials with HTTP basic
+// authentication; the route only exists when a secret is configured.
+func (app *application) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	clientId, clientSecret, ok := r.BasicAuth()
+	if !ok || !app.introspectionClientValid(clientId, clientSecret) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspection"`)
+		app.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil || r.PostForm.Get("token") == "" {
+		app.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	result, err := app.introspect(r.PostForm.Get("token"))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		app.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// accountAttemptKey returns the failed attempt counter of an account. Logins
+// for unknown emails are counted per email, so that they are throttled just
+// like logins for registered ones.
+func accountAttemptKey(userId int64, email string) string {
+	if userId < 0 {
+		return "email:" + strings.ToLower(email)
+	}
+
+	return fmt.Sprintf("user:%d", userId)
+}
+
+// ipAttemptKey returns the failed attempt counter of the caller's address.
+func (app *application) ipAttemptKey(ctx context.Context) string {
+	addr, ok := app.clientIP(ctx)
+	if !ok {
+		return "ip:unknown"
+	}
+
+	return "ip:" + addr.String()
+}
+
+// clientIP returns the address of the caller. Behind a trusted proxy, such
+// as the ingress, that is the last X-Forwarded-For hop not added by another
+// trusted proxy, since earlier entries are whatever the client sent.
+func (app *application) clientIP(ctx context.Context) (netip.Addr, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	addrPort, err := netip.ParseAddrPort(p.Addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	addr := addrPort.Addr().Unmap()
+	if !app.trustedProxy(addr) {
+		return addr, true
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	hops := strings.Split(strings.Join(md.Get("x-forwarded-for"), ","), ",")
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+
+		addr = hop.Unmap()
+		if !app.trustedProxy(addr) {
+			break
+		}
+	}
+
+	return addr, true
+}
+
+func (app *application) trustedProxy(addr netip.Addr) bool {
+	return slices.ContainsFunc(app.config.lockout.trustedProxies, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr)
+	})
+}
+
+// lockoutThresholds returns the number of failures after which the key backs
+// off and after which it is locked. An IP address is shared by many users
+// behind a NAT or proxy, so it gets more attempts than a single account.
+func (app *application) lockoutThresholds(key string) (backoffAfter, lockAfter int) {
+	if strings.HasPrefix(key, "ip:") {
+		return app.config.lockout.ipBackoffAfter, app.config.lockout.ipLockAfter
+	}
+
+	return app.config.lockout.backoffAfter, app.config.lockout.lockAfter
+}
+
+// lockoutDelay returns how long the key, with count failures and the last one
+// at last, has to wait before its next attempt: nothing below the backoff
+// threshold, a delay doubling with every failure above it, and the lock
+// duration once the lock threshold is reached.
+func (app *application) lockoutDelay(key string, count int, last time.Time) time.Duration {
+	backoffAfter, lockAfter := app.lockoutThresholds(key)
+	cfg := app.config.lockout
+
+	var delay time.Duration
+
+	switch {
+	case count >= lockAfter:
+		delay = cfg.lockDuration
+	case count >= backoffAfter:
+		delay = cfg.lockDuration
+		if shift := count - backoffAfter; shift < 32 {
+			delay = min(cfg.baseDelay<<shift, cfg.lockDuration)
+		}
+	default:
+		return 0
+	}
+
+	return max(time.Until(last.Add(delay)), 0)
+}
+
+// attempt is a credential check that counts as a failure against its keys
+// from the start, so that parallel checks cannot all slip under the lockout
+// thresholds. Checks that turn out not to have failed are taken back.
+type attempt struct {
+	app    *application
+	keys   []string
+	counts []int
+	done   bool
+}
+
+// beginAttempt counts an attempt against every key and rejects it while any
+// of them is backing off or locked, judged by the failures before it. A
+// rejected attempt is taken back but stays the latest one, so retrying before
+// the delay is up starts the delay over. Counters that fail let the attempt
+// through.
+func (app *application) beginAttempt(keys ...string) (*attempt, error) {
+	a := &attempt{app: app, done: !app.config.lockout.enabled}
+	if a.done {
+		return a, nil
+	}
+
+	for _, key := range keys {
+		count, previous, err := app.models.FailedAttempts.Record(key, app.config.lockout.window)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			continue
+		}
+
+		a.keys = append(a.keys, key)
+		a.counts = append(a.counts, count)
+
+		delay := app.lockoutDelay(key, count-1, previous)
+		if delay == 0 {
+			continue
+		}
+
+		a.end()
+
+		message := "too many failed attempts, try again later"
+		if _, lockAfter := app.lockoutThresholds(key); count-1 >= lockAfter {
+			message = "temporarily locked after too many failed attempts"
+		}
+
+		return nil, retryLaterError(message, delay)
+	}
+
+	return a, nil
+}
+
+// fail leaves the attempt counted as a failure.
+func (a *attempt) fail() {
+	if a.done {
+		return
+	}
+	a.done = true
+
+	for _, key := range a.keys {
+		if a.locked(key) {
+			a.app.logger.PrintInfo("locked after failed attempts", map[string]string{"key": key})
+		}
+	}
+}
+
+// locked reports whether the attempt, as a failure, is the one that locked
+// the key.
+func (a *attempt) locked(key string) bool {
+	i := slices.Index(a.keys, key)
+	if i < 0 {
+		return false
+	}
+
+	_, lockAfter := a.app.lockoutThresholds(key)
+	return a.counts[i] == lockAfter
+}
+
+// succeed takes the attempt back and clears the failures of resetKeys, e.g.
+// of the account after its correct password.
+func (a *attempt) succeed(resetKeys ...string) {
+	if a.done {
+		return
+	}
+	a.done = true
+
+	for _, key := range resetKeys {
+		a.app.resetFailedAttempts(key)
+	}
+
+	for _, key := range a.keys {
+		if !slices.Contains(resetKeys, key) {
+			a.app.refundAttempt(key)
+		}
+	}
+}
+
+// end takes the attempt back unless it failed or succeeded, such as when the
+// check could not be made. It is meant to be deferred.
+func (a *attempt) end() {
+	if a.done {
+		return
+	}
+	a.done = true
+
+	for _, key := range a.keys {
+		a.app.refundAttempt(key)
+	}
+}
+
+// retryLaterError returns a ResourceExhausted error whose RetryInfo tells the
+// client how long to wait.
+func retryLaterError(message string, delay time.Duration) error {
+	st, err := status.New(codes.ResourceExhausted, message).WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(delay.Round(time.Second)),
+	})
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, message)
+	}
+
+	return st.Err()
+}
+
+func (app *application) refundAttempt(key string) {
+	err := app.models.FailedAttempts.Refund(key)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// resetFailedAttempts clears the failures of the key, e.g. after a successful
+// login.
+func (app *application) resetFailedAttempts(key string) {
+	if !app.config.lockout.enabled {
+		return
+	}
+
+	err := app.models.FailedAttempts.Reset(key)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// UnlockAccount clears the failed login attempts of an account, lifting its
+// backoff or lock. It is reserved for callers with the accounts:unlock
+// permission.
+func (app *application) UnlockAccount(ctx context.Context, req *auth.UnlockAccountRequest) (*auth.UnlockAccountResponse, error) {
+	err := app.requirePermission(ctx, "accounts:unlock")
+	if err != nil {
+		return nil, err
+	}
+
+	if req.UserId < 1 {
+		return nil, status.Error(codes.InvalidArgument, "user id must be provided")
+	}
+
+	err = app.models.FailedAttempts.Reset(accountAttemptKey(req.UserId, ""))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.UnlockAccountResponse{}, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/validator"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// loginCodeDigits is the length of the numeric login codes sent by email.
+const loginCodeDigits = 6
+
+// loginCodeAttemptKey returns the counter of wrong login codes entered for a
+// user. Once it reaches the configured maximum, the outstanding code is void.
+func loginCodeAttemptKey(userId int64) string {
+	return fmt.Sprintf("login-code:%d", userId)
+}
+
+// loginCodeLockoutKey returns the failed attempt counter of a user's login
+// codes. Unlike the counter of the outstanding code, a new code does not
+// reset it, so wrong codes add up across codes until the user is locked.
+func loginCodeLockoutKey(userId int64) string {
+	return fmt.Sprintf("login-code-user:%d", userId)
+}
+
+// loginCodeRequestKey returns the counter of login codes requested for an
+// email.
+func loginCodeRequestKey(email string) string {
+	return "login-code-request:" + strings.ToLower(email)
+}
+
+// RequestLoginCode emails the user a 6 digit code or, when a magic link is
+// asked for, a token to embed in one, in the login-code scope. Only the
+// latest one stays valid. Like RequestPasswordReset, it succeeds whether or
+// not the email belongs to a user and does the work in the background. Each
+// email may only request a few codes per lockout window without logging in.
+func (app *application) RequestLoginCode(ctx context.Context, req *auth.RequestLoginCodeRequest) (*auth.RequestLoginCodeResponse, error) {
+	v := validator.New()
+
+	if data.ValidateEmail(v, req.Email); !v.Valid() {
+		return nil, status.Error(codes.InvalidArgument, "invalid email")
+	}
+
+	err := app.limitLoginCodeRequests(req.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := app.models.Users.GetByEmail(req.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return &auth.RequestLoginCodeResponse{}, nil
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	app.background(func() {
+		err := app.models.Tokens.DeleteAllForUser(data.ScopeLoginCode, user.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		// a new code gets the full number of attempts, while the wrong codes
+		// still count towards the user's lockout
+		app.resetLoginCodeAttempts(user.ID)
+
+		ttl := app.tokenTTL(data.ScopeLoginCode, 0)
+
+		if req.MagicLink {
+			token, err := app.models.Tokens.New(user.ID, ttl, data.ScopeLoginCode)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				return
+			}
+
+			app.sendEmail(user.Email, "login_link.tmpl", map[string]string{
+				"name":       user.Name,
+				"loginToken": token.Plaintext,
+				"expiry":     token.Expiry.Format(time.RFC1123),
+			})
+
+			return
+		}
+
+		token, err := app.models.Tokens.NewCode(user.ID, ttl, data.ScopeLoginCode, loginCodeDigits)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		app.sendEmail(user.Email, "login_code.tmpl", map[string]string{
+			"name":      user.Name,
+			"loginCode": token.Plaintext,
+			"expiry":    token.Expiry.Format(time.RFC1123),
+		})
+	})
+
+	return &auth.RequestLoginCodeResponse{}, nil
+}
+
+// CompleteLoginCode redeems a login code, given with the email it was sent
+// to, or a magic link token. The login then continues as after a password:
+// users with TOTP enabled get an mfa-pending token rather than a session.
+func (app *application) CompleteLoginCode(ctx context.Context, req *auth.CompleteLoginCodeRequest) (*auth.LoginResponse, error) {
+	attempt, err := app.beginAttempt(app.ipAttemptKey(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer attempt.end()
+
+	var token *data.Token
+
+	if req.Token != "" {
+		token, err = app.consumeLoginLink(req.Token)
+	} else {
+		token, err = app.consumeLoginCode(req.Email, req.Code)
+	}
+
+	if err != nil {
+		if status.Code(err) == codes.Unauthenticated {
+			attempt.fail()
+		}
+
+		return nil, err
+	}
+
+	attempt.succeed()
+
+	user, err := app.models.Users.GetByUserId(token.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired login code")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !user.Activated {
+		return nil, status.Error(codes.PermissionDenied, "user account must be activated")
+	}
+
+	app.resetFailedAttempts(loginCodeRequestKey(user.Email))
+
+	return app.completeLogin(ctx, user.ID, req.Client, req.UserAgent, data.AuthMethodEmail)
+}
+
+// consumeLoginLink spends a magic link token.
+func (app *application) consumeLoginLink(tokenPlaintext string) (*data.Token, error) {
+	scope, err := app.models.Tokens.Scope(data.ScopeLoginCode)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, tokenPlaintext, scope.PlaintextLength()); !v.Valid() {
+		return nil, status.Error(codes.Unauthenticated, "invalid or expired login code")
+	}
+
+	token, err := app.models.Tokens.Consume(data.ScopeLoginCode, tokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrTokenReused):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired login code")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return token, nil
+}
+
+// consumeLoginCode spends the numeric code sent to the email. Every wrong
+// code counts against the outstanding one, which is void once the configured
+// number of attempts is used up, so that the code cannot be guessed, and
+// against the user's login code lockout, so that neither can a run of codes.
+func (app *application) consumeLoginCode(email, code string) (*data.Token, error) {
+	v := validator.New()
+
+	data.ValidateEmail(v, email)
+	v.Check(len(code) == loginCodeDigits, "code", fmt.Sprintf("must be %d digits long", loginCodeDigits))
+
+	if !v.Valid() {
+		return nil, app.failedValidationError("invalid login code request", v)
+	}
+
+	user, err := app.models.Users.GetByEmail(email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired login code")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	lockoutKey := loginCodeLockoutKey(user.ID)
+
+	attempt, err := app.beginAttempt(lockoutKey)
+	if err != nil {
+		return nil, err
+	}
+	defer attempt.end()
+
+	token, err := app.models.Tokens.ConsumeCode(data.ScopeLoginCode, user.ID, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrTokenReused):
+			attempt.fail()
+			app.recordLoginCodeAttempt(user.ID)
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired login code")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	attempt.succeed(lockoutKey)
+	app.resetLoginCodeAttempts(user.ID)
+	return token, nil
+}
+
+// recordLoginCodeAttempt counts a wrong code for the user and voids the
+// outstanding code once the attempts are used up.
+func (app *application) recordLoginCodeAttempt(userId int64) {
+	count, _, err := app.models.FailedAttempts.Record(loginCodeAttemptKey(userId), app.tokenTTL(data.ScopeLoginCode, 0))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	if count < app.config.loginCode.maxAttempts {
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeLoginCode, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	app.resetLoginCodeAttempts(userId)
+}
+
+func (app *application) resetLoginCodeAttempts(userId int64) {
+	err := app.models.FailedAttempts.Reset(loginCodeAttemptKey(userId))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
+
+// limitLoginCodeRequests counts a login code request for the email, and
+// rejects it once the email has asked for the configured number of codes
+// within the lockout window without logging in with one. Unknown emails are
+// counted alike, so that the limit does not tell them apart. Counter lookups
+// that fail let the request through.
+func (app *application) limitLoginCodeRequests(email string) error {
+	if !app.config.lockout.enabled {
+		return nil
+	}
+
+	key := loginCodeRequestKey(email)
+
+	count, previous, err := app.models.FailedAttempts.Record(key, app.config.lockout.window)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil
+	}
+
+	if count > app.config.loginCode.maxRequests {
+		app.refundAttempt(key)
+		return retryLaterError("too many login codes requested, try again later", max(time.Until(previous.Add(app.config.lockout.window)), 0))
+	}
+
+	return nil
+}
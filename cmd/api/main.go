@@ -3,22 +3,36 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"google.golang.org/grpc/credentials/insecure"
 
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
 	_ "github.com/lib/pq"
 	"github.com/redis/go-redis/v9"
+	"github.com/saarwasserman/auth/internal/breach"
 	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/hasher"
 	"github.com/saarwasserman/auth/internal/jsonlog"
+	"github.com/saarwasserman/auth/internal/validator"
 	"github.com/saarwasserman/auth/internal/vcs"
 	"google.golang.org/grpc"
 
@@ -33,10 +47,15 @@ var (
 )
 
 type config struct {
-	port    int
-	env     string
-	session struct {
+	port         int
+	httpPort     int
+	internalAddr string
+	adminAddr    string
+	env          string
+	session      struct {
 		inactivityTime int
+		maxLifetime    time.Duration
+		maxPerUser     int
 	}
 	db struct {
 		dsn          string
@@ -58,27 +77,113 @@ type config struct {
 	}
 	cache struct {
 		endpoint string
+		tokenTTL time.Duration
+	}
+	jwt struct {
+		enabled  bool
+		issuer   string
+		rotation time.Duration
+		overlap  time.Duration
+		key      string
+	}
+	reaper struct {
+		enabled   bool
+		interval  time.Duration
+		batchSize int
+	}
+	lockout struct {
+		enabled        bool
+		window         time.Duration
+		backoffAfter   int
+		baseDelay      time.Duration
+		lockAfter      int
+		lockDuration   time.Duration
+		ipBackoffAfter int
+		ipLockAfter    int
+		trustedProxies []netip.Prefix
+	}
+	totp struct {
+		issuer string
+		key    string
+		skew   int
+	}
+	loginCode struct {
+		maxAttempts int
+		maxRequests int
+	}
+	stepUp struct {
+		maxAge time.Duration
+	}
+	webauthn struct {
+		rpId         string
+		rpName       string
+		rpOrigins    []string
+		challengeTTL time.Duration
+	}
+	introspection struct {
+		clientId     string
+		clientSecret string
+	}
+	password struct {
+		algorithm         string
+		argon2Memory      uint
+		argon2Iterations  uint
+		argon2Parallelism uint
+		bcryptCost        int
+		scryptLogN        uint
+		scryptR           int
+		scryptP           int
+		peppers           string
+		pepperFile        string
+		policy            data.PasswordPolicy
+		denyListFile      string
+		breachIndexFile   string
+		historySize       int
+		maxAge            time.Duration
+	}
+	tokens struct {
+		configFile string
+		overrides  []string
+		scopes     map[string]data.TokenScope
 	}
 }
 
 type application struct {
 	auth.UnimplementedAuthenticationServer
-	config   config
-	logger   *jsonlog.Logger
-	models   data.Models
-	notifier notifications.NotificationsClient
-	// cache *redis.Client
+	config      config
+	logger      *jsonlog.Logger
+	models      data.Models
+	notifier    notifications.NotificationsClient
+	signingKeys *signingKeySet
+	breachIndex *breach.Index
+	webAuthn    *webauthn.WebAuthn
+	wg          sync.WaitGroup
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "build-breach-index" {
+		err := buildBreachIndex(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	var cfg config
 
 	// server
 	flag.IntVar(&cfg.port, "port", 40020, "API Server port")
+	flag.IntVar(&cfg.httpPort, "http-port", 40021, "HTTP Server port (JWKS, introspection)")
+	flag.StringVar(&cfg.internalAddr, "internal-addr", "localhost:40022", "Address of the gRPC listener for trusted services, the only one serving CreateToken and the permission RPCs")
+	flag.StringVar(&cfg.adminAddr, "admin-addr", "localhost:40023", "Address of the HTTP listener for metrics (/debug/vars), kept off the public ports")
 	flag.StringVar(&cfg.env, "env", "development", "Environment(development|staging|production)")
 
 	// session
 	flag.IntVar(&cfg.session.inactivityTime, "session-inactivity-time", 5, "User inactivity duration in minutes")
+	flag.DurationVar(&cfg.session.maxLifetime, "session-max-lifetime", 30*24*time.Hour, "Absolute session lifetime regardless of activity (0 for unlimited)")
+	flag.IntVar(&cfg.session.maxPerUser, "session-max-per-user", 10, "Maximum concurrent sessions per user (0 for unlimited)")
 
 	// db
 	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("AUTH_DB_DSN"), "PostgreSQL DSN")
@@ -97,6 +202,98 @@ func main() {
 
 	// cache
 	flag.StringVar(&cfg.cache.endpoint, "cache-endpoint", os.Getenv("CACHE_ENDPOINT"), "Cache Endpoint")
+	flag.DurationVar(&cfg.cache.tokenTTL, "cache-token-ttl", time.Minute, "Maximum time a token lookup is cached")
+
+	// tokens
+	flag.StringVar(&cfg.tokens.configFile, "token-config", "", "Path to a JSON file with per-scope token settings")
+	flag.Func("token-scope", "Token scope settings as name:ttl=45m,size=16,single-use=true (repeatable)", func(val string) error {
+		cfg.tokens.overrides = append(cfg.tokens.overrides, val)
+		return nil
+	})
+
+	// password hashing
+	passwordHasher := hasher.New()
+	flag.StringVar(&cfg.password.algorithm, "password-hash-algorithm", passwordHasher.Algorithm, "Password hash algorithm (argon2id|bcrypt|scrypt)")
+	flag.UintVar(&cfg.password.argon2Memory, "password-argon2-memory", uint(passwordHasher.Argon2id.Memory), "Argon2id memory in KiB")
+	flag.UintVar(&cfg.password.argon2Iterations, "password-argon2-iterations", uint(passwordHasher.Argon2id.Iterations), "Argon2id iterations")
+	flag.UintVar(&cfg.password.argon2Parallelism, "password-argon2-parallelism", uint(passwordHasher.Argon2id.Parallelism), "Argon2id parallelism")
+	flag.IntVar(&cfg.password.bcryptCost, "password-bcrypt-cost", passwordHasher.Bcrypt.Cost, "Bcrypt cost")
+	flag.UintVar(&cfg.password.scryptLogN, "password-scrypt-ln", uint(passwordHasher.Scrypt.LogN), "Scrypt CPU/memory cost as log2(N)")
+	flag.IntVar(&cfg.password.scryptR, "password-scrypt-r", passwordHasher.Scrypt.R, "Scrypt block size")
+	flag.IntVar(&cfg.password.scryptP, "password-scrypt-p", passwordHasher.Scrypt.P, "Scrypt parallelism")
+	flag.StringVar(&cfg.password.peppers, "password-peppers", os.Getenv("AUTH_PASSWORD_PEPPERS"), "Password peppers as version:base64secret, comma separated")
+	flag.StringVar(&cfg.password.pepperFile, "password-pepper-file", "", "File with one version:base64secret password pepper per line (overrides -password-peppers)")
+
+	// password policy
+	cfg.password.policy = data.DefaultPasswordPolicy
+	flag.IntVar(&cfg.password.policy.MinLength, "password-min-length", cfg.password.policy.MinLength, "Minimum password length in bytes")
+	flag.IntVar(&cfg.password.policy.MinCharacterClasses, "password-min-character-classes", cfg.password.policy.MinCharacterClasses, "Number of character classes (lowercase, uppercase, digits, symbols) a password must contain (0 disables)")
+	flag.IntVar(&cfg.password.policy.MaxRepeatedCharacters, "password-max-repeated-characters", cfg.password.policy.MaxRepeatedCharacters, "Longest allowed run of one character in a password (0 disables)")
+	flag.BoolVar(&cfg.password.policy.ForbidPersonalInfo, "password-forbid-personal-info", cfg.password.policy.ForbidPersonalInfo, "Reject passwords containing the user's email or name")
+	flag.IntVar(&cfg.password.policy.MinStrength, "password-min-strength", cfg.password.policy.MinStrength, "Minimum zxcvbn password strength score (0-4)")
+	flag.StringVar(&cfg.password.denyListFile, "password-deny-list-file", "", "File with one denied password per line")
+	flag.DurationVar(&cfg.password.maxAge, "password-max-age", 0, "Password age after which login requires a password change, e.g. 2160h for 90 days (0 disables)")
+	flag.IntVar(&cfg.password.historySize, "password-history-size", 5, "Number of previous passwords a user may not reuse, besides the current one (0 disables)")
+	flag.StringVar(&cfg.password.breachIndexFile, "password-breach-index", "", "Breached password index built by the build-breach-index subcommand")
+
+	// jwt
+	flag.BoolVar(&cfg.jwt.enabled, "jwt-enabled", false, "Issue signed JWT access tokens in place of opaque ones")
+	flag.StringVar(&cfg.jwt.issuer, "jwt-issuer", "dinghy-auth", "JWT issuer claim")
+	flag.DurationVar(&cfg.jwt.rotation, "jwt-key-rotation", 7*24*time.Hour, "How often the JWT signing key is rotated")
+	flag.DurationVar(&cfg.jwt.overlap, "jwt-key-overlap", 48*time.Hour, "How long a rotated signing key keeps verifying tokens")
+	flag.StringVar(&cfg.jwt.key, "jwt-key-encryption-key", os.Getenv("AUTH_JWT_KEY"), "Base64 encoded 32 byte key that encrypts JWT signing keys (required with -jwt-enabled)")
+
+	// expired token reaper
+	flag.BoolVar(&cfg.reaper.enabled, "reaper-enabled", true, "Periodically delete expired tokens")
+	flag.DurationVar(&cfg.reaper.interval, "reaper-interval", 10*time.Minute, "Interval between expired token deletions")
+	flag.IntVar(&cfg.reaper.batchSize, "reaper-batch-size", 1000, "Maximum expired tokens deleted per statement")
+
+	// totp
+	flag.StringVar(&cfg.totp.issuer, "totp-issuer", "dinghy", "Issuer shown by authenticator apps")
+	flag.StringVar(&cfg.totp.key, "totp-key", os.Getenv("AUTH_TOTP_KEY"), "Base64 encoded 32 byte key that encrypts TOTP secrets (empty disables TOTP enrollment)")
+	flag.IntVar(&cfg.totp.skew, "totp-skew", 1, "Time steps of clock drift allowed either way for TOTP codes")
+
+	// login codes
+	flag.IntVar(&cfg.loginCode.maxAttempts, "login-code-max-attempts", 5, "Wrong login codes after which the outstanding code is void")
+	flag.IntVar(&cfg.loginCode.maxRequests, "login-code-max-requests", 5, "Login codes one email may request within -lockout-window without logging in with one")
+
+	// step-up
+	flag.DurationVar(&cfg.stepUp.maxAge, "step-up-max-age", 10*time.Minute, "How recent a login sensitive methods require (0 only checks its strength)")
+
+	// webauthn
+	flag.StringVar(&cfg.webauthn.rpId, "webauthn-rp-id", "", "WebAuthn relying party id, the domain passkeys are bound to (empty disables passkeys)")
+	flag.StringVar(&cfg.webauthn.rpName, "webauthn-rp-name", "dinghy", "WebAuthn relying party name shown by authenticators")
+	flag.Func("webauthn-rp-origins", "Origins passkey ceremonies may come from (space separated)", func(val string) error {
+		cfg.webauthn.rpOrigins = strings.Fields(val)
+		return nil
+	})
+	flag.DurationVar(&cfg.webauthn.challengeTTL, "webauthn-challenge-ttl", 5*time.Minute, "How long a passkey ceremony may take to finish")
+
+	// lockout
+	flag.BoolVar(&cfg.lockout.enabled, "lockout-enabled", true, "Throttle and lock accounts and IPs after failed credential checks")
+	flag.DurationVar(&cfg.lockout.window, "lockout-window", time.Hour, "Time without failures after which failed attempt counters start over")
+	flag.IntVar(&cfg.lockout.backoffAfter, "lockout-backoff-after", 3, "Failed attempts after which retries are delayed exponentially")
+	flag.DurationVar(&cfg.lockout.baseDelay, "lockout-base-delay", time.Second, "First retry delay, doubled on every further failure")
+	flag.IntVar(&cfg.lockout.lockAfter, "lockout-lock-after", 10, "Failed attempts after which the account or IP is locked")
+	flag.DurationVar(&cfg.lockout.lockDuration, "lockout-duration", 15*time.Minute, "How long a lock lasts")
+	flag.IntVar(&cfg.lockout.ipBackoffAfter, "lockout-ip-backoff-after", 20, "Failed attempts from one IP after which its retries are delayed exponentially")
+	flag.IntVar(&cfg.lockout.ipLockAfter, "lockout-ip-lock-after", 100, "Failed attempts from one IP after which the IP is locked")
+	flag.Func("lockout-trusted-proxies", "Proxy CIDRs whose X-Forwarded-For header names the client IP (space separated)", func(val string) error {
+		for _, field := range strings.Fields(val) {
+			prefix, err := netip.ParsePrefix(field)
+			if err != nil {
+				return err
+			}
+
+			cfg.lockout.trustedProxies = append(cfg.lockout.trustedProxies, prefix.Masked())
+		}
+
+		return nil
+	})
+
+	// introspection
+	flag.StringVar(&cfg.introspection.clientId, "introspection-client-id", "introspection", "Client id that token introspection callers authenticate as")
+	flag.StringVar(&cfg.introspection.clientSecret, "introspection-client-secret", os.Getenv("INTROSPECTION_CLIENT_SECRET"), "Client secret that token introspection callers authenticate with (empty disables introspection)")
 
 	// cors
 	flag.Func("cors-trusted-origins", "Trusted CORS Origins (space separated)", func(val string) error {
@@ -115,6 +312,165 @@ func main() {
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	tokenScopes, err := data.LoadTokenScopes(cfg.tokens.configFile, cfg.tokens.overrides)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+		return
+	}
+
+	cfg.tokens.scopes = tokenScopes
+
+	if cfg.jwt.enabled && cfg.jwt.overlap < tokenScopes[data.ScopeAuthentication].TTL {
+		logger.PrintFatal(errors.New("jwt-key-overlap must not be shorter than the authentication token ttl"), nil)
+		return
+	}
+
+	if cfg.jwt.enabled && cfg.jwt.rotation <= signingKeyPublishDelay {
+		logger.PrintFatal(fmt.Errorf("jwt-key-rotation must be longer than %s", signingKeyPublishDelay), nil)
+		return
+	}
+
+	if cfg.lockout.enabled && (cfg.lockout.lockAfter <= cfg.lockout.backoffAfter || cfg.lockout.ipLockAfter <= cfg.lockout.ipBackoffAfter || cfg.lockout.window < cfg.lockout.lockDuration) {
+		logger.PrintFatal(errors.New("lock-after thresholds must exceed backoff-after thresholds and lockout-window must not be shorter than lockout-duration"), nil)
+		return
+	}
+
+	if cfg.introspection.clientSecret == "" {
+		logger.PrintInfo("introspection client secret not configured, token introspection disabled", nil)
+	}
+
+	if cfg.reaper.enabled && (cfg.reaper.interval <= 0 || cfg.reaper.batchSize < 1) {
+		logger.PrintFatal(errors.New("reaper-interval and reaper-batch-size must be positive"), nil)
+		return
+	}
+
+	if cfg.loginCode.maxAttempts < 1 {
+		logger.PrintFatal(errors.New("login-code-max-attempts must be at least 1"), nil)
+		return
+	}
+
+	if cfg.loginCode.maxRequests < 1 {
+		logger.PrintFatal(errors.New("login-code-max-requests must be at least 1"), nil)
+		return
+	}
+
+	if !validator.In(cfg.password.algorithm, hasher.AlgorithmArgon2id, hasher.AlgorithmBcrypt, hasher.AlgorithmScrypt) {
+		logger.PrintFatal(hasher.ErrUnknownAlgorithm, map[string]string{"algorithm": cfg.password.algorithm})
+		return
+	}
+
+	if cfg.password.argon2Memory > math.MaxUint32 || cfg.password.argon2Iterations > math.MaxUint32 || cfg.password.argon2Parallelism > math.MaxUint8 || cfg.password.scryptLogN > math.MaxUint8 {
+		logger.PrintFatal(fmt.Errorf("%w: out of range", hasher.ErrInvalidParams), nil)
+		return
+	}
+
+	passwordHasher.Algorithm = cfg.password.algorithm
+	passwordHasher.Argon2id.Memory = uint32(cfg.password.argon2Memory)
+	passwordHasher.Argon2id.Iterations = uint32(cfg.password.argon2Iterations)
+	passwordHasher.Argon2id.Parallelism = uint8(cfg.password.argon2Parallelism)
+	passwordHasher.Bcrypt.Cost = cfg.password.bcryptCost
+	passwordHasher.Scrypt.LogN = uint8(cfg.password.scryptLogN)
+	passwordHasher.Scrypt.R = cfg.password.scryptR
+	passwordHasher.Scrypt.P = cfg.password.scryptP
+
+	err = passwordHasher.Validate()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+		return
+	}
+
+	if cfg.password.pepperFile != "" {
+		content, err := os.ReadFile(cfg.password.pepperFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+			return
+		}
+
+		cfg.password.peppers = string(content)
+	}
+
+	peppers, err := hasher.ParsePeppers(cfg.password.peppers)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+		return
+	}
+
+	if peppers.Current == 0 {
+		logger.PrintInfo("password pepper not configured, hashing passwords without one", nil)
+	}
+
+	if cfg.password.denyListFile != "" {
+		cfg.password.policy.DenyList, err = data.LoadDenyList(cfg.password.denyListFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+			return
+		}
+	}
+
+	v := validator.New()
+
+	if data.ValidatePasswordPolicy(v, cfg.password.policy); !v.Valid() {
+		logger.PrintFatal(errors.New("invalid password policy"), v.Errors)
+		return
+	}
+
+	var totpKey []byte
+
+	if cfg.totp.key != "" {
+		totpKey, err = base64.StdEncoding.DecodeString(cfg.totp.key)
+		if err != nil || len(totpKey) != 32 {
+			logger.PrintFatal(errors.New("totp-key must be 32 bytes, base64 encoded"), nil)
+			return
+		}
+	}
+
+	var signingKeyKey []byte
+
+	if cfg.jwt.enabled {
+		signingKeyKey, err = base64.StdEncoding.DecodeString(cfg.jwt.key)
+		if err != nil || len(signingKeyKey) != 32 {
+			logger.PrintFatal(errors.New("jwt-key-encryption-key must be 32 bytes, base64 encoded"), nil)
+			return
+		}
+	}
+
+	var webAuthn *webauthn.WebAuthn
+
+	if cfg.webauthn.rpId != "" {
+		// passkeys are passwordless, so the authenticator itself has to
+		// verify the user, and discoverable, so that login needs no email
+		webAuthn, err = webauthn.New(&webauthn.Config{
+			RPID:          cfg.webauthn.rpId,
+			RPDisplayName: cfg.webauthn.rpName,
+			RPOrigins:     cfg.webauthn.rpOrigins,
+			AuthenticatorSelection: protocol.AuthenticatorSelection{
+				RequireResidentKey: protocol.ResidentKeyRequired(),
+				ResidentKey:        protocol.ResidentKeyRequirementRequired,
+				UserVerification:   protocol.VerificationRequired,
+			},
+		})
+		if err != nil {
+			logger.PrintFatal(err, nil)
+			return
+		}
+	}
+
+	var breachIndex *breach.Index
+
+	if cfg.password.breachIndexFile != "" {
+		breachIndex, err = breach.Open(cfg.password.breachIndexFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+			return
+		}
+
+		defer breachIndex.Close()
+
+		logger.PrintInfo("breached password index loaded", map[string]string{
+			"hashes": strconv.FormatUint(breachIndex.Len(), 10),
+		})
+	}
+
 	db, err := openDB(cfg)
 	if err != nil {
 		logger.PrintFatal(err, nil)
@@ -150,43 +506,155 @@ func main() {
 
 	defer conn.Close()
 
-	ctx := context.Background()
+	var cache *redis.Client
+	var tokenCache *data.TokenCache
 
-	// try redis
-	cache := redis.NewClient(&redis.Options{
-		Addr: cfg.cache.endpoint,
-	})
+	if cfg.cache.endpoint != "" {
+		cache = redis.NewClient(&redis.Options{
+			Addr:         cfg.cache.endpoint,
+			DialTimeout:  time.Second,
+			ReadTimeout:  200 * time.Millisecond,
+			WriteTimeout: 200 * time.Millisecond,
+		})
 
-	res, err := cache.Set(ctx, "name", "saar", 0).Result()
-	if err != nil {
-		log.Fatal(err)
-		return
-	}
+		defer cache.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		err = cache.Ping(ctx).Err()
+		cancel()
 
-	fmt.Println(res)
+		if err != nil {
+			// token lookups and failed attempt counters fall back to the
+			// database until redis is reachable
+			logger.PrintError(err, nil)
+		} else {
+			logger.PrintInfo("cache connection established", nil)
+		}
+
+		tokenCache = data.NewTokenCache(cache, cfg.cache.tokenTTL)
+	}
 
 	app := &application{
-		config:   cfg,
-		logger:   logger,
-		models:   data.NewModels(db),
-		notifier: notifications.NewNotificationsClient(conn),
-		//cache: cache,
+		config:      cfg,
+		logger:      logger,
+		models:      data.NewModels(db, cache, cfg.tokens.scopes, tokenCache, passwordHasher, peppers, cfg.password.historySize, totpKey, signingKeyKey),
+		notifier:    notifications.NewNotificationsClient(conn),
+		signingKeys: &signingKeySet{},
+		breachIndex: breachIndex,
+		webAuthn:    webAuthn,
+	}
+
+	shutdownCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if cfg.jwt.enabled {
+		err = app.rotateSigningKeys()
+		if err != nil {
+			app.logger.PrintFatal(err, nil)
+			return
+		}
+
+		app.background(func() {
+			app.runSigningKeyRotation(shutdownCtx)
+		})
 	}
 
+	if cfg.reaper.enabled {
+		app.background(func() {
+			app.runTokenReaper(shutdownCtx)
+		})
+	}
+
+	httpServer := &http.Server{
+		Addr:    fmt.Sprintf(":%d", app.config.httpPort),
+		Handler: app.routes(),
+	}
+
+	go func() {
+		app.logger.PrintInfo(fmt.Sprintf("http listening on %s", httpServer.Addr), nil)
+		err := httpServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logger.PrintError(err, nil)
+		}
+	}()
+
+	adminServer := &http.Server{
+		Addr:    app.config.adminAddr,
+		Handler: app.adminRoutes(),
+	}
+
+	go func() {
+		app.logger.PrintInfo(fmt.Sprintf("admin listening on %s", adminServer.Addr), nil)
+		err := adminServer.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			app.logger.PrintError(err, nil)
+		}
+	}()
+
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", app.config.port))
 	if err != nil {
 		app.logger.PrintFatal(err, nil)
 		return
 	}
 
+	internalListener, err := net.Listen("tcp", app.config.internalAddr)
+	if err != nil {
+		app.logger.PrintFatal(err, nil)
+		return
+	}
+
+	authInterceptor := selector.UnaryServerInterceptor(
+		middlewareAuth.UnaryServerInterceptor(app.Authenticator),
+		selector.MatchFunc(app.AuthMatcher),
+	)
+
 	serviceRegistrar := grpc.NewServer(grpc.ChainUnaryInterceptor(
-		// authentication
+		// internal methods
 		selector.UnaryServerInterceptor(
-			middlewareAuth.UnaryServerInterceptor(app.Authenticator),
-			selector.MatchFunc(app.AuthMatcher),
+			middlewareAuth.UnaryServerInterceptor(app.denyInternal),
+			selector.MatchFunc(app.InternalMatcher),
 		),
+		// authentication
+		authInterceptor,
 	))
 
+	internalRegistrar := grpc.NewServer(grpc.ChainUnaryInterceptor(
+		// authentication
+		authInterceptor,
+	))
+
+	go func() {
+		<-shutdownCtx.Done()
+
+		app.logger.PrintInfo("shutting down server", nil)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+
+		err := httpServer.Shutdown(ctx)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		err = adminServer.Shutdown(ctx)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+
+		internalRegistrar.GracefulStop()
+		serviceRegistrar.GracefulStop()
+	}()
+
+	auth.RegisterAuthenticationServer(internalRegistrar, app)
+
+	go func() {
+		app.logger.PrintInfo(fmt.Sprintf("internal listening on %s", internalListener.Addr().String()), nil)
+		err := internalRegistrar.Serve(internalListener)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}()
+
 	app.logger.PrintInfo(fmt.Sprintf("listening on %s", listener.Addr().String()), nil)
 	auth.RegisterAuthenticationServer(serviceRegistrar, app)
 	err = serviceRegistrar.Serve(listener)
@@ -194,6 +662,28 @@ func main() {
 		log.Fatalf("cannot serve %s", err)
 		return
 	}
+
+	app.logger.PrintInfo("waiting for background tasks", nil)
+	app.wg.Wait()
+
+	app.logger.PrintInfo("stopped server", nil)
+}
+
+// background runs fn in a goroutine that shutdown waits for.
+func (app *application) background(fn func()) {
+	app.wg.Add(1)
+
+	go func() {
+		defer app.wg.Done()
+
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		fn()
+	}()
 }
 
 func openDB(cfg config) (*sql.DB, error) {
@@ -2,18 +2,18 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
+	"path"
 	"slices"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors"
 	interceptorsAuth "github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
 
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
 	"github.com/saarwasserman/auth/internal/data"
-	"github.com/saarwasserman/auth/internal/validator"
 )
 
 func (app *application) Authenticator(ctx context.Context) (context.Context, error) {
@@ -23,30 +23,101 @@ func (app *application) Authenticator(ctx context.Context) (context.Context, err
 		return ctx, status.Error(codes.Unauthenticated, "missing bearer token")
 	}
 
-	v := validator.New()
+	method, _ := grpc.Method(ctx)
 
-	if data.ValidateTokenPlaintext(v, token); !v.Valid() {
-		return ctx, status.Error(codes.Unauthenticated, "invalid auth token")
+	// token - check expiration and session activity, in every scope the
+	// method accepts
+	var authToken *data.Token
+	for _, scope := range app.methodScopes(path.Base(method)) {
+		authToken, err = app.isValidAuthenticationToken(scope, token)
+		if err == nil {
+			break
+		}
 	}
 
-	// token - check expiration
-	userId, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+	// lockout - only invalid tokens count against and are held back by the
+	// caller's IP, so that callers sharing it keep working with valid ones
 	if err != nil {
-		switch {
-		case errors.Is(err, data.ErrRecordNotFound):
-			return ctx, status.Error(codes.Unauthenticated, "invalid auth token")
-		default:
-			return ctx, status.Error(codes.Unauthenticated, err.Error())
+		if status.Code(err) == codes.Unauthenticated {
+			ipKey := app.ipAttemptKey(ctx)
+
+			attempt, lockErr := app.beginAttempt(ipKey)
+			if lockErr != nil {
+				return ctx, lockErr
+			}
+
+			attempt.fail()
 		}
+
+		return ctx, err
 	}
 
-	ctx = app.contextSetUserId(ctx, userId)
+	// step-up - sensitive methods also need a strong and recent login. Tokens
+	// of restricted scopes, such as the password-change token, are issued by
+	// a login just now for that one method
+	if policy, ok := app.methodAuthPolicy(path.Base(method)); ok && authToken.Scope == data.ScopeAuthentication {
+		err = app.checkAuthPolicy(authToken, policy)
+		if err != nil {
+			return ctx, err
+		}
+	}
+
+	ctx = app.contextSetUserId(ctx, authToken.UserID)
+	ctx = app.contextSetSessionId(ctx, authToken.SessionID)
+	ctx = app.contextSetScope(ctx, authToken.Scope)
+	ctx = app.contextSetAuthMethods(ctx, authToken.AuthMethods)
 	return ctx, nil
 }
 
+// methodScopes returns the token scopes a method accepts. Restricted scopes,
+// such as the password-change token issued for an expired password, are only
+// good for the methods listed here.
+func (app *application) methodScopes(method string) []string {
+	switch method {
+	case "ChangePassword":
+		return []string{data.ScopeAuthentication, data.ScopePasswordChange}
+	case "VerifyTotp":
+		return []string{data.ScopeMfaPending}
+	default:
+		return []string{data.ScopeAuthentication}
+	}
+}
+
 func (app *application) AuthMatcher(ctx context.Context, callMeta interceptors.CallMeta) bool {
 	// var requiredAuthenticationServices = []string{auth.UsersService_ServiceDesc.ServiceName}
-	// methods := []string{auth.Authentication_ServiceDesc.Methods[1].MethodName}
-	var methods []string
+	methods := []string{
+		"ListSessions",
+		"RevokeSession",
+		"RevokeOtherSessions",
+		"ChangePassword",
+		"SetPassword",
+		"UnlockAccount",
+		"BeginTotpEnrollment",
+		"ConfirmTotpEnrollment",
+		"DisableTotp",
+		"VerifyTotp",
+		"RegenerateRecoveryCodes",
+		"BeginPasskeyRegistration",
+		"FinishPasskeyRegistration",
+	}
 	return slices.Contains(methods, callMeta.Method)
 }
+
+// internalMethods are served on the internal listener only. They issue and
+// revoke tokens and grant permissions for any user without authenticating the
+// caller, so only trusted services may reach them.
+var internalMethods = []string{
+	"CreateToken",
+	"DeleteAllTokensForUser",
+	"AddPermissionForUser",
+	"RemovePermissionForUser",
+}
+
+func (app *application) InternalMatcher(ctx context.Context, callMeta interceptors.CallMeta) bool {
+	return slices.Contains(internalMethods, callMeta.Method)
+}
+
+// denyInternal refuses the internal methods on the public listener.
+func (app *application) denyInternal(ctx context.Context) (context.Context, error) {
+	return ctx, status.Error(codes.PermissionDenied, "method is only served on the internal listener")
+}
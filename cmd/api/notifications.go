@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/saarwasserman/auth/protogen/notifications"
+)
+
+// sendEmail asks the notifications service to send the templated email in the
+// background, so that callers neither wait for delivery nor fail on it.
+func (app *application) sendEmail(recipient, templateFile string, data map[string]string) {
+	app.background(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err := app.notifier.SendEmail(ctx, &notifications.EmailRequest{
+			Recipient:    recipient,
+			TemplateFile: templateFile,
+			Data:         data,
+		})
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"template": templateFile,
+			})
+		}
+	})
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Ceremonies in progress are kept apart by kind, so that the state of one
+// cannot be used to finish the other.
+const (
+	passkeyCeremonyRegistration = "registration"
+	passkeyCeremonyLogin        = "login"
+)
+
+// passkeyUser adapts a user and their passkeys to webauthn.User. The user
+// handle is the big endian user id, which reveals nothing personal.
+type passkeyUser struct {
+	user     *data.User
+	passkeys []*data.Passkey
+}
+
+func passkeyUserHandle(userId int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(userId))
+}
+
+func passkeyUserId(userHandle []byte) (int64, error) {
+	if len(userHandle) != 8 {
+		return 0, fmt.Errorf("invalid user handle of %d bytes", len(userHandle))
+	}
+
+	return int64(binary.BigEndian.Uint64(userHandle)), nil
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	return passkeyUserHandle(u.user.ID)
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.user.Name
+}
+
+func (u *passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.passkeys))
+
+	for i, passkey := range u.passkeys {
+		transports := make([]protocol.AuthenticatorTransport, len(passkey.Transports))
+		for j, transport := range passkey.Transports {
+			transports[j] = protocol.AuthenticatorTransport(transport)
+		}
+
+		credentials[i] = webauthn.Credential{
+			ID:              passkey.ID,
+			PublicKey:       passkey.PublicKey,
+			AttestationType: passkey.AttestationType,
+			Transport:       transports,
+			Flags: webauthn.CredentialFlags{
+				BackupEligible: passkey.BackupEligible,
+				BackupState:    passkey.BackupState,
+			},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    passkey.AAGUID,
+				SignCount: passkey.SignCount,
+			},
+		}
+	}
+
+	return credentials
+}
+
+// loadPasskeyUser returns the user with their registered passkeys.
+func (app *application) loadPasskeyUser(ctx context.Context, userId int64) (*passkeyUser, error) {
+	user, err := app.models.Users.GetByUserId(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := app.models.Passkeys.GetAllForUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &passkeyUser{user: user, passkeys: passkeys}, nil
+}
+
+// savePasskeyCeremony keeps the state of a ceremony, challenge included,
+// until the client finishes it or the challenge ttl runs out.
+func (app *application) savePasskeyCeremony(ctx context.Context, ceremony string, session *webauthn.SessionData) (string, error) {
+	state, err := json.Marshal(session)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return "", status.Error(codes.Internal, err.Error())
+	}
+
+	id, err := app.models.PasskeyChallenges.Save(ctx, ceremony, state, app.config.webauthn.challengeTTL)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrMissingCache):
+			return "", status.Error(codes.FailedPrecondition, "passkeys are not configured")
+		default:
+			app.logger.PrintError(err, nil)
+			return "", status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return id, nil
+}
+
+// takePasskeyCeremony returns the state of a ceremony and ends it, so that
+// each challenge is answered at most once.
+func (app *application) takePasskeyCeremony(ctx context.Context, ceremony, id string) (*webauthn.SessionData, error) {
+	state, err := app.models.PasskeyChallenges.Take(ctx, ceremony, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "passkey ceremony not found or expired")
+		case errors.Is(err, data.ErrMissingCache):
+			return nil, status.Error(codes.FailedPrecondition, "passkeys are not configured")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	var session webauthn.SessionData
+
+	err = json.Unmarshal(state, &session)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &session, nil
+}
+
+// BeginPasskeyRegistration starts registering a passkey for the caller. The
+// options are the JSON PublicKeyCredentialCreationOptions for
+// navigator.credentials.create().
+func (app *application) BeginPasskeyRegistration(ctx context.Context, req *auth.BeginPasskeyRegistrationRequest) (*auth.BeginPasskeyRegistrationResponse, error) {
+	if app.webAuthn == nil {
+		return nil, status.Error(codes.FailedPrecondition, "passkeys are not configured")
+	}
+
+	userId := app.contextGetUserId(ctx)
+
+	user, err := app.loadPasskeyUser(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	// keep authenticators from registering a second passkey for the user
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	creation, session, err := app.webAuthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	options, err := json.Marshal(creation)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	ceremonyId, err := app.savePasskeyCeremony(ctx, passkeyCeremonyRegistration, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.BeginPasskeyRegistrationResponse{
+		CeremonyId: ceremonyId,
+		Options:    options,
+	}, nil
+}
+
+// FinishPasskeyRegistration verifies the attestation the authenticator made
+// for the ceremony and stores the new passkey.
+func (app *application) FinishPasskeyRegistration(ctx context.Context, req *auth.FinishPasskeyRegistrationRequest) (*auth.FinishPasskeyRegistrationResponse, error) {
+	if app.webAuthn == nil {
+		return nil, status.Error(codes.FailedPrecondition, "passkeys are not configured")
+	}
+
+	userId := app.contextGetUserId(ctx)
+
+	session, err := app.takePasskeyCeremony(ctx, passkeyCeremonyRegistration, req.CeremonyId)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := app.loadPasskeyUser(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid passkey credential")
+	}
+
+	// fails as well if the ceremony was started by another user
+	credential, err := app.webAuthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "passkey attestation could not be verified")
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, transport := range credential.Transport {
+		transports[i] = string(transport)
+	}
+
+	passkey := &data.Passkey{
+		ID:              credential.ID,
+		UserID:          userId,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+		BackupState:     credential.Flags.BackupState,
+	}
+
+	err = app.models.Passkeys.Insert(ctx, passkey)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicatePasskey):
+			return nil, status.Error(codes.AlreadyExists, "passkey is registered already")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &auth.FinishPasskeyRegistrationResponse{
+		CredentialId: passkey.ID,
+	}, nil
+}
+
+// BeginPasskeyLogin starts a passwordless login. No email is asked for: the
+// authenticator offers the user's discoverable passkeys, and the assertion
+// names the user. The options are the JSON PublicKeyCredentialRequestOptions
+// for navigator.credentials.get().
+func (app *application) BeginPasskeyLogin(ctx context.Context, req *auth.BeginPasskeyLoginRequest) (*auth.BeginPasskeyLoginResponse, error) {
+	if app.webAuthn == nil {
+		return nil, status.Error(codes.FailedPrecondition, "passkeys are not configured")
+	}
+
+	assertion, session, err := app.webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	options, err := json.Marshal(assertion)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	ceremonyId, err := app.savePasskeyCeremony(ctx, passkeyCeremonyLogin, session)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.BeginPasskeyLoginResponse{
+		CeremonyId: ceremonyId,
+		Options:    options,
+	}, nil
+}
+
+// FinishPasskeyLogin verifies the assertion the authenticator made for the
+// ceremony and starts a session. A passkey verified by the authenticator is
+// two factors in itself, so TOTP users are not asked for a code.
+func (app *application) FinishPasskeyLogin(ctx context.Context, req *auth.FinishPasskeyLoginRequest) (*auth.LoginResponse, error) {
+	if app.webAuthn == nil {
+		return nil, status.Error(codes.FailedPrecondition, "passkeys are not configured")
+	}
+
+	attempt, err := app.beginAttempt(app.ipAttemptKey(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer attempt.end()
+
+	session, err := app.takePasskeyCeremony(ctx, passkeyCeremonyLogin, req.CeremonyId)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(req.Credential))
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid passkey assertion")
+	}
+
+	var user *passkeyUser
+	var lookupErr error
+
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userId, err := passkeyUserId(userHandle)
+		if err != nil {
+			return nil, err
+		}
+
+		user, lookupErr = app.loadPasskeyUser(ctx, userId)
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+
+		return user, nil
+	}
+
+	credential, err := app.webAuthn.ValidateDiscoverableLogin(findUser, *session, parsed)
+	if err != nil {
+		if lookupErr != nil && !errors.Is(lookupErr, data.ErrRecordNotFound) {
+			app.logger.PrintError(lookupErr, nil)
+			return nil, status.Error(codes.Internal, lookupErr.Error())
+		}
+
+		attempt.fail()
+		return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+	}
+
+	// a sign count that did not increase means a replayed assertion or a
+	// cloned authenticator
+	if credential.Authenticator.CloneWarning {
+		attempt.fail()
+		return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+	}
+
+	err = app.models.Passkeys.Use(ctx, credential.ID, credential.Authenticator.SignCount, credential.Flags.BackupState)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrSignCountReplayed):
+			attempt.fail()
+			return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !user.user.Activated {
+		return nil, status.Error(codes.PermissionDenied, "user account must be activated")
+	}
+
+	accessToken, refreshToken, err := app.startSession(user.user.ID, req.Client, req.UserAgent, []string{data.AuthMethodPasskey}, 0)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.LoginResponse{
+		UserId:                user.user.ID,
+		TokenPlaintext:        accessToken.Plaintext,
+		Expiry:                accessToken.Expiry.UnixMilli(),
+		RefreshTokenPlaintext: refreshToken.Plaintext,
+		RefreshExpiry:         refreshToken.Expiry.UnixMilli(),
+		SessionId:             accessToken.SessionID,
+		State:                 loginStateAuthenticated,
+	}, nil
+}
@@ -2,20 +2,288 @@ package main
 
 import (
 	"context"
+	"errors"
+	"time"
 
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/hasher"
+	"github.com/saarwasserman/auth/internal/validator"
 	"github.com/saarwasserman/auth/protogen/auth"
-	"golang.org/x/crypto/bcrypt"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// setPassword hashes the plaintext password and stores it as the user's
+// credentials, replacing any existing ones.
+func (app *application) setPassword(ctx context.Context, userId int64, plaintextPassword string) error {
+	hash, pepperVersion, err := app.models.Passwords.Hash(plaintextPassword)
+	if err != nil {
+		switch {
+		case errors.Is(err, hasher.ErrPasswordTooLong):
+			return status.Error(codes.InvalidArgument, err.Error())
+		default:
+			app.logger.PrintError(err, nil)
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = app.models.Passwords.SetPasswordForUserId(ctx, userId, hash, pepperVersion)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	return nil
+}
+
+// checkPasswordPolicy validates a new password of the user against the
+// configured password policy, the breached password index and the user's
+// password history. Users unknown to the users table are checked without their
+// personal information.
+func (app *application) checkPasswordPolicy(ctx context.Context, v *validator.Validator, key string, userId int64, plaintextPassword string) error {
+	user, err := app.models.Users.GetByUserId(userId)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	app.config.password.policy.Validate(v, key, plaintextPassword, user)
+
+	err = app.checkBreachedPassword(v, key, plaintextPassword)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	// checking the history costs a hash per entry, so it is skipped for
+	// passwords that are rejected anyway
+	if v.Valid() {
+		reused, err := app.models.Passwords.MatchesHistory(ctx, userId, plaintextPassword)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return status.Error(codes.Internal, err.Error())
+		}
+
+		v.Check(!reused, key+".reused", "must not be one of your recent passwords")
+	}
+
+	return nil
+}
+
+// SetPassword replaces any user's password without asking for the current
+// one, so it is reserved for callers with the credentials:write permission.
 func (app *application) SetPassword(ctx context.Context, req *auth.SetPasswordRequest) (*auth.SetPasswordResponse, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), 12)
+	err := app.requirePermission(ctx, "credentials:write")
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
+	}
+
+	v := validator.New()
+
+	err = app.checkPasswordPolicy(ctx, v, "password", req.UserId, req.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	if !v.Valid() {
+		return nil, app.failedValidationError("invalid password", v)
 	}
 
-	app.models.Passwords.CreatePasswordForUserId(req.UserId, hash)
+	err = app.setPassword(ctx, req.UserId, req.Password)
+	if err != nil {
+		return nil, err
+	}
 
 	return &auth.SetPasswordResponse{}, nil
 }
+
+func (app *application) ChangePassword(ctx context.Context, req *auth.ChangePasswordRequest) (*auth.ChangePasswordResponse, error) {
+	userId := app.contextGetUserId(ctx)
+	currentSessionId := app.contextGetSessionId(ctx)
+
+	v := validator.New()
+
+	if v.Check(req.CurrentPassword != "", "current_password", "must be provided"); !v.Valid() {
+		return nil, app.failedValidationError("invalid password change request", v)
+	}
+
+	// the current password is checked first, so that the history check of the
+	// new one cannot tell a stolen session which passwords the user has had
+	accountKey := accountAttemptKey(userId, "")
+
+	attempt, err := app.beginAttempt(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	defer attempt.end()
+
+	match, _, err := app.models.Passwords.Matches(ctx, userId, req.CurrentPassword)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !match {
+		attempt.fail()
+		return nil, status.Error(codes.Unauthenticated, "invalid authentication credentials")
+	}
+
+	attempt.succeed(accountKey)
+
+	err = app.checkPasswordPolicy(ctx, v, "new_password", userId, req.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	if !v.Valid() {
+		return nil, app.failedValidationError("invalid password change request", v)
+	}
+
+	err = app.setPassword(ctx, userId, req.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Tokens.DeleteAllForUserExcept(userId, currentSessionId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	// a password-change token has done its job, the user logs in again
+	if app.contextGetScope(ctx) == data.ScopePasswordChange {
+		err = app.models.Tokens.DeleteAllForUser(data.ScopePasswordChange, userId)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &auth.ChangePasswordResponse{}, nil
+}
+
+// RequestPasswordReset emails a password reset token to the user. It succeeds
+// whether or not the email belongs to a user, and the token is issued in the
+// background, so that neither the result nor the timing reveals which emails
+// are registered.
+func (app *application) RequestPasswordReset(ctx context.Context, req *auth.RequestPasswordResetRequest) (*auth.RequestPasswordResetResponse, error) {
+	v := validator.New()
+
+	if data.ValidateEmail(v, req.Email); !v.Valid() {
+		return nil, status.Error(codes.InvalidArgument, "invalid email")
+	}
+
+	user, err := app.models.Users.GetByEmail(req.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return &auth.RequestPasswordResetResponse{}, nil
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	app.background(func() {
+		// only the latest reset token stays valid
+		err := app.models.Tokens.DeleteAllForUser(data.ScopePasswordReset, user.ID)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		token, err := app.models.Tokens.New(user.ID, app.tokenTTL(data.ScopePasswordReset, 0), data.ScopePasswordReset)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return
+		}
+
+		app.sendEmail(user.Email, "password_reset.tmpl", map[string]string{
+			"name":               user.Name,
+			"passwordResetToken": token.Plaintext,
+			"expiry":             token.Expiry.Format(time.RFC1123),
+		})
+	})
+
+	return &auth.RequestPasswordResetResponse{}, nil
+}
+
+// ResetPassword sets a new password for the owner of a password reset token
+// and signs the user out everywhere. The token is spent even when the scope
+// is not configured as single use.
+func (app *application) ResetPassword(ctx context.Context, req *auth.ResetPasswordRequest) (*auth.ResetPasswordResponse, error) {
+	scope, err := app.models.Tokens.Scope(data.ScopePasswordReset)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, req.TokenPlaintext, scope.PlaintextLength()); !v.Valid() {
+		return nil, status.Error(codes.Unauthenticated, "invalid or expired password reset token")
+	}
+
+	// the token is only spent once the new password passes the policy, so a
+	// rejected password can be retried with the same email
+	token, err := app.models.Tokens.GetForToken(data.ScopePasswordReset, req.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired password reset token")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = app.checkPasswordPolicy(ctx, v, "new_password", token.UserID, req.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	if !v.Valid() {
+		return nil, app.failedValidationError("invalid password reset request", v)
+	}
+
+	token, err = app.models.Tokens.Consume(data.ScopePasswordReset, req.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound), errors.Is(err, data.ErrTokenReused):
+			return nil, status.Error(codes.Unauthenticated, "invalid or expired password reset token")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = app.setPassword(ctx, token.UserID, req.NewPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	// the spent reset token has a session of its own, so this revokes every
+	// session of the user
+	err = app.models.Tokens.DeleteAllForUserExcept(token.UserID, token.SessionID)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.ResetPasswordResponse{}, nil
+}
+
+// rehashPassword upgrades a hash made with an outdated algorithm, parameters
+// or pepper while the plaintext is at hand. A failure only delays the upgrade
+// to the next login.
+func (app *application) rehashPassword(ctx context.Context, userId int64, plaintextPassword string) {
+	hash, pepperVersion, err := app.models.Passwords.Hash(plaintextPassword)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return
+	}
+
+	err = app.models.Passwords.UpdatePasswordForUserId(ctx, userId, hash, pepperVersion)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
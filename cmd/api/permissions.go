@@ -8,6 +8,26 @@ import (
 	"google.golang.org/grpc/status"
 )
 
+// requirePermission rejects callers whose user lacks the permission code. It
+// must only be used by methods that the Authenticator runs for.
+func (app *application) requirePermission(ctx context.Context, code string) error {
+	userId := app.contextGetUserId(ctx)
+
+	permissions, err := app.models.Permissions.GetAllForUser(userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if !permissions.Include(code) {
+		return status.Error(codes.PermissionDenied, "missing permission "+code)
+	}
+
+	return nil
+}
+
+// AddPermissionForUser and RemovePermissionForUser are internal methods, see
+// internalMethods.
 func (app *application) AddPermissionForUser(ctx context.Context, req *auth.AddPermissionForUserRequest) (*auth.AddPermissionForUserResponse, error) {
 	err := app.models.Permissions.AddForUser(req.UserId, req.Codes...)
 	if err != nil {
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+)
+
+var (
+	reaperRuns            = expvar.NewInt("token_reaper_runs")
+	reaperSkippedRuns     = expvar.NewInt("token_reaper_skipped_runs")
+	reaperDeletedTotal    = expvar.NewInt("token_reaper_deleted_total")
+	reaperLastDeleted     = expvar.NewInt("token_reaper_last_deleted")
+	reaperLastDurationMs  = expvar.NewInt("token_reaper_last_duration_ms")
+	reaperTotalDurationMs = expvar.NewInt("token_reaper_total_duration_ms")
+)
+
+// runTokenReaper deletes expired tokens on every tick until ctx is done.
+func (app *application) runTokenReaper(ctx context.Context) {
+	ticker := time.NewTicker(app.config.reaper.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			app.reapExpiredTokens(ctx)
+		}
+	}
+}
+
+func (app *application) reapExpiredTokens(ctx context.Context) {
+	start := time.Now()
+
+	deleted, err := app.models.Tokens.DeleteExpired(ctx, app.config.reaper.batchSize)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrLockHeld):
+			// another replica is reaping
+			reaperSkippedRuns.Add(1)
+			return
+		case errors.Is(err, context.Canceled):
+			// shutting down, record what was deleted so far
+		default:
+			app.logger.PrintError(err, nil)
+		}
+	}
+
+	if app.config.lockout.enabled && ctx.Err() == nil {
+		_, err = app.models.FailedAttempts.DeleteExpired(ctx, app.config.lockout.window)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+		}
+	}
+
+	duration := time.Since(start).Milliseconds()
+
+	reaperRuns.Add(1)
+	reaperDeletedTotal.Add(deleted)
+	reaperLastDeleted.Set(deleted)
+	reaperLastDurationMs.Set(duration)
+	reaperTotalDurationMs.Add(duration)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+)
+
+func (app *application) routes() http.Handler {
+	mux := http.NewServeMux()
+
+	if app.config.introspection.clientSecret != "" {
+		mux.HandleFunc("POST /introspect", app.introspectHandler)
+	}
+
+	if app.config.jwt.enabled {
+		mux.HandleFunc("GET /.well-known/jwks.json", app.jwksHandler)
+	}
+
+	return mux
+}
+
+// adminRoutes serves operational endpoints, such as the expvar metrics with
+// the database pool stats, on the admin listener only.
+func (app *application) adminRoutes() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.Handle("GET /debug/vars", expvar.Handler())
+
+	return mux
+}
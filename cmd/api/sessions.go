@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (app *application) sessionPolicy() data.SessionPolicy {
+	return data.SessionPolicy{
+		InactivityTime: time.Duration(app.config.session.inactivityTime) * time.Minute,
+		MaxLifetime:    app.config.session.maxLifetime,
+	}
+}
+
+// checkSessionActivity rejects access tokens of sessions that have been idle
+// for longer than the inactivity time or open for longer than the maximum
+// lifetime. Tokens that pass extend the session, at most once a minute.
+func (app *application) checkSessionActivity(token *data.Token) error {
+	now := time.Now()
+	policy := app.sessionPolicy()
+
+	err := policy.CheckAccess(token, now)
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	throttle := time.Minute
+	if policy.InactivityTime > 0 && policy.InactivityTime/2 < throttle {
+		throttle = policy.InactivityTime / 2
+	}
+
+	if now.Sub(token.LastUsedAt) > throttle {
+		err := app.models.Sessions.Touch(token.SessionID, now.Add(-throttle))
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// checkSessionRefresh rejects refresh tokens of sessions that have been idle
+// for longer than the inactivity time or open for longer than the maximum
+// lifetime. Using an access token touches every token of its session, so
+// the refresh token's last use is the session's.
+func (app *application) checkSessionRefresh(token *data.Token) error {
+	err := app.sessionPolicy().CheckAccess(token, time.Now())
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return nil
+}
+
+func (app *application) ListSessions(ctx context.Context, req *auth.ListSessionsRequest) (*auth.ListSessionsResponse, error) {
+	userId := app.contextGetUserId(ctx)
+	currentSessionId := app.contextGetSessionId(ctx)
+
+	sessions, err := app.models.Sessions.GetAllForUser(userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	res := &auth.ListSessionsResponse{}
+	for _, session := range sessions {
+		res.Sessions = append(res.Sessions, &auth.Session{
+			SessionId: session.ID,
+			Client:    session.Client,
+			UserAgent: session.UserAgent,
+			CreatedAt: session.CreatedAt.UnixMilli(),
+			Expiry:    session.Expiry.UnixMilli(),
+			Current:   session.ID == currentSessionId,
+		})
+	}
+
+	return res, nil
+}
+
+func (app *application) RevokeSession(ctx context.Context, req *auth.RevokeSessionRequest) (*auth.RevokeSessionResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	if req.SessionId == "" {
+		return nil, status.Error(codes.InvalidArgument, "session id must be provided")
+	}
+
+	err := app.models.Sessions.DeleteForUser(userId, req.SessionId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "session not found")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &auth.RevokeSessionResponse{}, nil
+}
+
+func (app *application) RevokeOtherSessions(ctx context.Context, req *auth.RevokeOtherSessionsRequest) (*auth.RevokeOtherSessionsResponse, error) {
+	userId := app.contextGetUserId(ctx)
+	currentSessionId := app.contextGetSessionId(ctx)
+
+	err := app.models.Sessions.DeleteAllForUserExcept(userId, currentSessionId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.RevokeOtherSessionsResponse{}, nil
+}
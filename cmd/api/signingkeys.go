@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/jwt"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// jwksMaxAge is how long verifiers may cache the JWKS.
+	jwksMaxAge = 5 * time.Minute
+
+	// signingKeyReload is how often replicas reload the active keys.
+	signingKeyReload = time.Minute
+
+	// signingKeyPublishDelay is how long a new key is only published before it
+	// signs tokens, so that every replica and verifier knows it by then.
+	signingKeyPublishDelay = jwksMaxAge + signingKeyReload
+)
+
+// signingKeySet caches the active signing keys so that tokens are signed and
+// verified without a database round trip.
+type signingKeySet struct {
+	mu   sync.RWMutex
+	keys []*data.SigningKey
+}
+
+// current returns the key that signs new tokens, the newest one that has been
+// published for at least signingKeyPublishDelay. Until a key has, such as on
+// the very first start, the oldest key signs.
+func (s *signingKeySet) current() (*data.SigningKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.keys) == 0 {
+		return nil, false
+	}
+
+	for _, key := range s.keys {
+		if time.Since(key.CreatedAt) >= signingKeyPublishDelay {
+			return key, true
+		}
+	}
+
+	return s.keys[len(s.keys)-1], true
+}
+
+func (s *signingKeySet) publicKey(keyID string) (ed25519.PublicKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, key := range s.keys {
+		if key.ID == keyID && time.Now().Before(key.ExpiresAt) {
+			return key.PublicKey, true
+		}
+	}
+
+	return nil, false
+}
+
+func (s *signingKeySet) jwks() jwt.JWKS {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	jwks := jwt.JWKS{Keys: []jwt.JWK{}}
+	for _, key := range s.keys {
+		jwks.Keys = append(jwks.Keys, jwt.NewJWK(key.ID, key.PublicKey))
+	}
+
+	return jwks
+}
+
+// rotateSigningKeys creates a new key signingKeyPublishDelay before the
+// current one is older than the rotation period, so that the new key takes
+// over signing on time, and reloads the active keys. A key stays valid for the
+// rotation period plus the overlap, so tokens signed just before a rotation
+// still verify until they expire.
+func (app *application) rotateSigningKeys() error {
+	keys, err := app.models.SigningKeys.GetAllActive()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) == 0 || time.Since(keys[0].CreatedAt) >= app.config.jwt.rotation-signingKeyPublishDelay {
+		key, err := data.NewSigningKey(app.config.jwt.rotation + app.config.jwt.overlap)
+		if err != nil {
+			return err
+		}
+
+		err = app.models.SigningKeys.Insert(key)
+		if err != nil {
+			return err
+		}
+
+		app.logger.PrintInfo("signing key rotated", map[string]string{
+			"kid": key.ID,
+		})
+
+		keys = append([]*data.SigningKey{key}, keys...)
+	}
+
+	err = app.models.SigningKeys.DeleteExpired()
+	if err != nil {
+		return err
+	}
+
+	app.signingKeys.mu.Lock()
+	app.signingKeys.keys = keys
+	app.signingKeys.mu.Unlock()
+
+	return nil
+}
+
+// runSigningKeyRotation checks the keys every signingKeyReload, which also
+// picks up keys rotated by other replicas, until ctx is done.
+func (app *application) runSigningKeyRotation(ctx context.Context) {
+	ticker := time.NewTicker(signingKeyReload)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := app.rotateSigningKeys()
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}
+	}
+}
+
+// createAccessJWT issues a signed access token for the session in place of an
+// opaque one. It cannot be revoked before it expires, and is not tracked per
+// use, so its expiry stands in for the session inactivity and lifetime checks.
+func (app *application) createAccessJWT(userId int64, session *data.Session, ttl time.Duration) (*data.Token, error) {
+	key, ok := app.signingKeys.current()
+	if !ok {
+		return nil, errors.New("no signing key available")
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := jwt.NewID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	token := &data.Token{
+		UserID:      userId,
+		Expiry:      app.sessionPolicy().AccessExpiry(session, now.Add(ttl), now),
+		Scope:       data.ScopeAuthentication,
+		SessionID:   session.ID,
+		CreatedAt:   session.CreatedAt,
+		AuthMethods: session.AuthMethods,
+		AuthTime:    session.AuthTime,
+	}
+
+	var authTime int64
+	if !session.AuthTime.IsZero() {
+		authTime = session.AuthTime.Unix()
+	}
+
+	token.Plaintext, err = jwt.Sign(jwt.Claims{
+		Issuer:      app.config.jwt.issuer,
+		Subject:     strconv.FormatInt(userId, 10),
+		Scope:       data.ScopeAuthentication,
+		Expiry:      token.Expiry.Unix(),
+		IssuedAt:    now.Unix(),
+		ID:          id,
+		SessionID:   session.ID,
+		Permissions: permissions,
+		AuthMethods: session.AuthMethods,
+		AuthTime:    authTime,
+		ACR:         authenticationACR(session.AuthMethods),
+	}, key.ID, key.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+// verifyAccessJWT checks a signed access token and returns it in the same
+// shape as an opaque token looked up from the database.
+func (app *application) verifyAccessJWT(tokenPlaintext string) (*data.Token, error) {
+	claims, err := jwt.Verify(tokenPlaintext, app.signingKeys.publicKey, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	userId, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || claims.Scope != data.ScopeAuthentication {
+		return nil, jwt.ErrInvalidToken
+	}
+
+	token := &data.Token{
+		Plaintext:   tokenPlaintext,
+		UserID:      userId,
+		Expiry:      time.Unix(claims.Expiry, 0),
+		Scope:       claims.Scope,
+		SessionID:   claims.SessionID,
+		CreatedAt:   time.Unix(claims.IssuedAt, 0),
+		AuthMethods: claims.AuthMethods,
+	}
+
+	if claims.AuthTime > 0 {
+		token.AuthTime = time.Unix(claims.AuthTime, 0)
+	}
+
+	return token, nil
+}
+
+func (app *application) GetSigningKeys(ctx context.Context, req *auth.GetSigningKeysRequest) (*auth.GetSigningKeysResponse, error) {
+	if !app.config.jwt.enabled {
+		return nil, status.Error(codes.FailedPrecondition, "signed access tokens are not enabled")
+	}
+
+	res := &auth.GetSigningKeysResponse{}
+	for _, key := range app.signingKeys.jwks().Keys {
+		res.Keys = append(res.Keys, &auth.SigningKey{
+			Kid: key.KeyID,
+			Kty: key.KeyType,
+			Crv: key.Curve,
+			X:   key.X,
+			Alg: key.Algorithm,
+			Use: key.Use,
+		})
+	}
+
+	return res, nil
+}
+
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(jwksMaxAge.Seconds())))
+
+	err := json.NewEncoder(w).Encode(app.signingKeys.jwks())
+	if err != nil {
+		app.logger.PrintError(err, nil)
+	}
+}
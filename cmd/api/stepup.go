@@ -0,0 +1,111 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Authentication context class references, after the NIST authenticator
+// assurance levels, from weakest to strongest.
+const (
+	acrSingleFactor = "aal1"
+	acrMultiFactor  = "aal2"
+)
+
+var acrLevels = []string{acrSingleFactor, acrMultiFactor}
+
+// errorReasonInsufficientAuthentication is the ErrorInfo reason of a token
+// that is valid, but not strong or recent enough for the method, as in the
+// insufficient_user_authentication error of RFC 9470.
+const errorReasonInsufficientAuthentication = "INSUFFICIENT_USER_AUTHENTICATION"
+
+// authenticationACR returns the acr the authentication methods reach: aal2
+// for a passkey, which the authenticator only releases after verifying the
+// user, or for a password or email code together with a TOTP or recovery
+// code, aal1 for any other method, and none without methods, e.g. for
+// tokens issued by CreateToken.
+func authenticationACR(methods []string) string {
+	has := func(candidates ...string) bool {
+		return slices.ContainsFunc(candidates, func(method string) bool {
+			return slices.Contains(methods, method)
+		})
+	}
+
+	switch {
+	case has(data.AuthMethodPasskey),
+		has(data.AuthMethodPassword, data.AuthMethodEmail) && has(data.AuthMethodTotp, data.AuthMethodRecoveryCode):
+		return acrMultiFactor
+	case len(methods) > 0:
+		return acrSingleFactor
+	default:
+		return ""
+	}
+}
+
+// acrSatisfies reports whether acr is at least as strong as required.
+func acrSatisfies(acr, required string) bool {
+	return slices.Index(acrLevels, acr) >= slices.Index(acrLevels, required)
+}
+
+// authPolicy is the authentication a method requires beyond a valid token:
+// a minimum acr, reached no longer than maxAge ago.
+type authPolicy struct {
+	acr    string
+	maxAge time.Duration
+}
+
+// methodAuthPolicy returns the policy of a sensitive method, and false for
+// methods that any valid token will do for. Adding a second factor or a
+// passkey, or changing the password, needs a recent login, so that an old
+// session cannot take over the account's credentials.
+func (app *application) methodAuthPolicy(method string) (authPolicy, bool) {
+	switch method {
+	case "DisableTotp", "RegenerateRecoveryCodes":
+		return authPolicy{acr: acrMultiFactor, maxAge: app.config.stepUp.maxAge}, true
+	case "BeginPasskeyRegistration", "BeginTotpEnrollment", "ConfirmTotpEnrollment", "ChangePassword":
+		return authPolicy{acr: acrSingleFactor, maxAge: app.config.stepUp.maxAge}, true
+	default:
+		return authPolicy{}, false
+	}
+}
+
+// checkAuthPolicy rejects a token whose login was weaker or longer ago than
+// the policy allows. The Unauthenticated error carries an ErrorInfo with the
+// acr_values and max_age, in seconds, that the client has to log in again
+// with, and the acr the token has.
+func (app *application) checkAuthPolicy(token *data.Token, policy authPolicy) error {
+	acr := authenticationACR(token.AuthMethods)
+
+	strong := acrSatisfies(acr, policy.acr)
+	recent := policy.maxAge <= 0 || (!token.AuthTime.IsZero() && time.Since(token.AuthTime) <= policy.maxAge)
+
+	if strong && recent {
+		return nil
+	}
+
+	message := "stronger authentication required"
+	if strong {
+		message = "more recent authentication required"
+	}
+
+	st, err := status.New(codes.Unauthenticated, message).WithDetails(&errdetails.ErrorInfo{
+		Reason: errorReasonInsufficientAuthentication,
+		Domain: app.config.jwt.issuer,
+		Metadata: map[string]string{
+			"acr_values": policy.acr,
+			"max_age":    strconv.FormatInt(int64(policy.maxAge.Seconds()), 10),
+			"acr":        acr,
+		},
+	})
+	if err != nil {
+		return status.Error(codes.Unauthenticated, message)
+	}
+
+	return st.Err()
+}
@@ -2,24 +2,162 @@ package main
 
 import (
 	"context"
+	"errors"
 	"time"
 
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/validator"
 	"github.com/saarwasserman/auth/protogen/auth"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
+// tokenTTL returns the lifetime of a new token in the scope, honoring the
+// requested ttl when it is within the scope's maximum.
+func (app *application) tokenTTL(scope string, requested time.Duration) time.Duration {
+	return app.models.Tokens.Scopes[scope].Lifetime(requested)
+}
+
+// createAuthenticationTokens issues an access token and the refresh token that
+// can later be swapped for a new pair. Both tokens belong to the given session.
+func (app *application) createAuthenticationTokens(userId int64, session *data.Session, requestedTTL time.Duration) (*data.Token, *data.Token, error) {
+	var accessToken *data.Token
+	var err error
+
+	if app.config.jwt.enabled {
+		accessToken, err = app.createAccessJWT(userId, session, app.tokenTTL(data.ScopeAuthentication, requestedTTL))
+	} else {
+		accessToken, err = app.models.Tokens.NewForSession(userId, app.tokenTTL(data.ScopeAuthentication, requestedTTL), data.ScopeAuthentication, session)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refreshToken, err := app.models.Tokens.NewForSession(userId, app.tokenTTL(data.ScopeRefresh, 0), data.ScopeRefresh, session)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// startSession opens a new session for the user, authenticated with the given
+// methods just now, and evicts the oldest ones once the per-user session
+// limit is exceeded.
+func (app *application) startSession(userId int64, client, userAgent string, methods []string, requestedTTL time.Duration) (*data.Token, *data.Token, error) {
+	session, err := data.NewSession(client, userAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(methods) > 0 {
+		session.AuthMethods = methods
+		session.AuthTime = session.CreatedAt
+	}
+
+	accessToken, refreshToken, err := app.createAuthenticationTokens(userId, session, requestedTTL)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if app.config.session.maxPerUser > 0 {
+		err = app.models.Sessions.DeleteOldestForUser(userId, app.config.session.maxPerUser)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return accessToken, refreshToken, nil
+}
+
 func (app *application) CreateToken(ctx context.Context, req *auth.TokenCreationRequest) (*auth.TokenCreationResponse, error) {
-	app.models.Tokens.DeleteAllForUser(req.Scope, req.UserId)
+	if _, err := app.models.Tokens.Scope(req.Scope); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "invalid token scope")
+	}
+
+	requestedTTL := time.Duration(req.TtlSeconds) * time.Second
+
+	if req.Scope != data.ScopeAuthentication {
+		app.models.Tokens.DeleteAllForUser(req.Scope, req.UserId)
+
+		token, err := app.models.Tokens.New(req.UserId, app.tokenTTL(req.Scope, requestedTTL), req.Scope)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		return &auth.TokenCreationResponse{
+			TokenPlaintext: token.Plaintext,
+			Expiry:         token.Expiry.UnixMilli(),
+		}, nil
+	}
+
+	accessToken, refreshToken, err := app.startSession(req.UserId, req.Client, req.UserAgent, nil, requestedTTL)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.TokenCreationResponse{
+		TokenPlaintext:        accessToken.Plaintext,
+		Expiry:                accessToken.Expiry.UnixMilli(),
+		RefreshTokenPlaintext: refreshToken.Plaintext,
+		RefreshExpiry:         refreshToken.Expiry.UnixMilli(),
+		SessionId:             accessToken.SessionID,
+	}, nil
+}
+
+func (app *application) RefreshToken(ctx context.Context, req *auth.RefreshTokenRequest) (*auth.TokenCreationResponse, error) {
+	v := validator.New()
+
+	refreshScope, err := app.models.Tokens.Scope(data.ScopeRefresh)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if data.ValidateTokenPlaintext(v, req.RefreshTokenPlaintext, refreshScope.PlaintextLength()); !v.Valid() {
+		return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+	}
+
+	token, err := app.models.Tokens.Consume(data.ScopeRefresh, req.RefreshTokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		case errors.Is(err, data.ErrTokenReused):
+			// a used refresh token means it leaked, so nothing issued from it can be trusted
+			app.logger.PrintInfo("refresh token reused, revoking session", map[string]string{
+				"session_id": token.SessionID,
+			})
+
+			err = app.models.Sessions.Delete(token.SessionID)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			return nil, status.Error(codes.Unauthenticated, "invalid refresh token")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	err = app.checkSessionRefresh(token)
+	if err != nil {
+		return nil, err
+	}
 
-	token, err := app.models.Tokens.New(req.UserId, 24*time.Hour, req.Scope)
+	accessToken, refreshToken, err := app.createAuthenticationTokens(token.UserID, token.Session(), 0)
 	if err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &auth.TokenCreationResponse{
-		TokenPlaintext: token.Plaintext,
-		Expiry:         token.Expiry.UnixMilli(),
+		TokenPlaintext:        accessToken.Plaintext,
+		Expiry:                accessToken.Expiry.UnixMilli(),
+		RefreshTokenPlaintext: refreshToken.Plaintext,
+		RefreshExpiry:         refreshToken.Expiry.UnixMilli(),
+		SessionId:             accessToken.SessionID,
 	}, nil
 }
 
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/totp"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// totpAttemptKey returns the failed attempt counter of a user's TOTP codes.
+// It is separate from the login counter, which a correct password resets.
+func totpAttemptKey(userId int64) string {
+	return fmt.Sprintf("totp:%d", userId)
+}
+
+// verifyTotpCode checks a code against the user's TOTP secret, allowing the
+// configured clock drift, and spends its time step so that it cannot be
+// replayed. confirmed selects whether the secret must be confirmed or still
+// pending. Failures count towards the user's TOTP lockout.
+func (app *application) verifyTotpCode(ctx context.Context, userId int64, code string, confirmed bool) error {
+	attemptKey := totpAttemptKey(userId)
+
+	attempt, err := app.beginAttempt(attemptKey)
+	if err != nil {
+		return err
+	}
+	defer attempt.end()
+
+	secret, err := app.models.Totp.GetForUser(ctx, userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return status.Error(codes.FailedPrecondition, "totp enrollment not found")
+		default:
+			app.logger.PrintError(err, nil)
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	switch {
+	case confirmed && !secret.Confirmed:
+		return status.Error(codes.FailedPrecondition, "totp is not enabled")
+	case !confirmed && secret.Confirmed:
+		return status.Error(codes.FailedPrecondition, "totp is already enabled")
+	}
+
+	step, ok := totp.Validate(secret.Secret, code, time.Now(), app.config.totp.skew)
+	if ok && step > secret.LastUsedStep {
+		err = app.models.Totp.UseStep(ctx, userId, step)
+	}
+
+	switch {
+	case !ok, step <= secret.LastUsedStep, errors.Is(err, data.ErrTotpStepUsed):
+		attempt.fail()
+		return status.Error(codes.Unauthenticated, "invalid totp code")
+	case err != nil:
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	attempt.succeed(attemptKey)
+	return nil
+}
+
+// verifyRecoveryCode spends one of the user's recovery codes. Failures count
+// towards the same lockout as TOTP codes.
+func (app *application) verifyRecoveryCode(ctx context.Context, userId int64, code string) error {
+	attemptKey := totpAttemptKey(userId)
+
+	attempt, err := app.beginAttempt(attemptKey)
+	if err != nil {
+		return err
+	}
+	defer attempt.end()
+
+	enabled, err := app.models.Totp.Enabled(ctx, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	if !enabled {
+		return status.Error(codes.FailedPrecondition, "totp is not enabled")
+	}
+
+	err = app.models.RecoveryCodes.Consume(ctx, userId, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			attempt.fail()
+			return status.Error(codes.Unauthenticated, "invalid recovery code")
+		default:
+			app.logger.PrintError(err, nil)
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	attempt.succeed(attemptKey)
+	return nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or, in its place, one
+// of the user's recovery codes, which are told apart by their length. It
+// returns the authentication method of the code.
+func (app *application) verifySecondFactor(ctx context.Context, userId int64, code string) (string, error) {
+	if len(code) == totp.Digits {
+		return data.AuthMethodTotp, app.verifyTotpCode(ctx, userId, code, true)
+	}
+
+	return data.AuthMethodRecoveryCode, app.verifyRecoveryCode(ctx, userId, code)
+}
+
+// replaceRecoveryCodes generates a new set of recovery codes for the user,
+// invalidating the previous set, and returns their plaintexts.
+func (app *application) replaceRecoveryCodes(ctx context.Context, userId int64) ([]string, error) {
+	recoveryCodes, err := data.NewRecoveryCodes()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = app.models.RecoveryCodes.ReplaceForUser(ctx, userId, recoveryCodes)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return recoveryCodes, nil
+}
+
+// BeginTotpEnrollment creates a pending TOTP secret for the caller. It only
+// takes effect once confirmed with a code from the authenticator app.
+func (app *application) BeginTotpEnrollment(ctx context.Context, req *auth.BeginTotpEnrollmentRequest) (*auth.BeginTotpEnrollmentResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	user, err := app.models.Users.GetByUserId(userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = app.models.Totp.InsertPending(ctx, userId, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTotpEnabled):
+			return nil, status.Error(codes.FailedPrecondition, "totp is already enabled")
+		case errors.Is(err, data.ErrMissingTotpKey):
+			return nil, status.Error(codes.FailedPrecondition, "totp is not configured")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return &auth.BeginTotpEnrollmentResponse{
+		Secret: secret,
+		Uri:    totp.URI(app.config.totp.issuer, user.Email, secret),
+	}, nil
+}
+
+// ConfirmTotpEnrollment enables the caller's pending TOTP secret and returns
+// the first set of recovery codes. They are shown only this once.
+func (app *application) ConfirmTotpEnrollment(ctx context.Context, req *auth.ConfirmTotpEnrollmentRequest) (*auth.ConfirmTotpEnrollmentResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	err := app.verifyTotpCode(ctx, userId, req.Code, false)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err := app.replaceRecoveryCodes(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &auth.ConfirmTotpEnrollmentResponse{
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// RegenerateRecoveryCodes replaces the caller's recovery codes with a new set
+// and lets the user know by email, in case it was not them.
+func (app *application) RegenerateRecoveryCodes(ctx context.Context, req *auth.RegenerateRecoveryCodesRequest) (*auth.RegenerateRecoveryCodesResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	user, err := app.models.Users.GetByUserId(userId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return nil, status.Error(codes.NotFound, "user not found")
+		default:
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	enabled, err := app.models.Totp.Enabled(ctx, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !enabled {
+		return nil, status.Error(codes.FailedPrecondition, "totp is not enabled")
+	}
+
+	recoveryCodes, err := app.replaceRecoveryCodes(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	app.sendEmail(user.Email, "recovery_codes_regenerated.tmpl", map[string]string{
+		"name":          user.Name,
+		"regeneratedAt": time.Now().Format(time.RFC1123),
+	})
+
+	return &auth.RegenerateRecoveryCodesResponse{
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// DisableTotp removes the caller's TOTP secret and recovery codes. It takes a
+// current code or a recovery code, so that a stolen session alone cannot turn
+// the second factor off.
+func (app *application) DisableTotp(ctx context.Context, req *auth.DisableTotpRequest) (*auth.DisableTotpResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	_, err := app.verifySecondFactor(ctx, userId, req.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Totp.DeleteForUser(ctx, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	err = app.models.RecoveryCodes.DeleteAllForUser(ctx, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.DisableTotpResponse{}, nil
+}
+
+// VerifyTotp exchanges the mfa-pending token that Login issues to TOTP users,
+// together with a code or a recovery code, for a session. The session is
+// authenticated with the first factor the mfa-pending token records and the
+// code. After a password login with an expired password it is exchanged for
+// a password-change token instead.
+func (app *application) VerifyTotp(ctx context.Context, req *auth.VerifyTotpRequest) (*auth.LoginResponse, error) {
+	userId := app.contextGetUserId(ctx)
+
+	method, err := app.verifySecondFactor(ctx, userId, req.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := append(slices.Clone(app.contextGetAuthMethods(ctx)), method)
+
+	if slices.Contains(methods, data.AuthMethodPassword) {
+		expired, err := app.passwordExpired(ctx, userId)
+		if err != nil {
+			app.logger.PrintError(err, nil)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		if expired {
+			err = app.models.Tokens.DeleteAllForUser(data.ScopeMfaPending, userId)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+				return nil, status.Error(codes.Internal, err.Error())
+			}
+
+			return app.passwordChangeLogin(userId)
+		}
+	}
+
+	return app.completeMfaLogin(userId, req.Client, req.UserAgent, methods)
+}
+
+// completeMfaLogin spends the user's mfa-pending tokens and opens the session
+// that Login held back.
+func (app *application) completeMfaLogin(userId int64, client, userAgent string, methods []string) (*auth.LoginResponse, error) {
+	err := app.models.Tokens.DeleteAllForUser(data.ScopeMfaPending, userId)
+	if err != nil {
+		app.logger.PrintError(err, nil)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	accessToken, refreshToken, err := app.startSession(userId, client, userAgent, methods, 0)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &auth.LoginResponse{
+		UserId:                userId,
+		TokenPlaintext:        accessToken.Plaintext,
+		Expiry:                accessToken.Expiry.UnixMilli(),
+		RefreshTokenPlaintext: refreshToken.Plaintext,
+		RefreshExpiry:         refreshToken.Expiry.UnixMilli(),
+		SessionId:             accessToken.SessionID,
+		State:                 loginStateAuthenticated,
+	}, nil
+}
@@ -0,0 +1,223 @@
+// Package breach checks passwords against a local copy of a breached password
+// corpus, such as the Pwned Passwords SHA-1 dump, without network calls.
+//
+// The dump is converted once into a compact index of the first 8 bytes of
+// every SHA-1 hash, sorted, behind a fan-out table on the first 2 bytes. A
+// lookup reads the fan-out table from memory and binary searches one bucket
+// on disk. Truncating the hashes makes false positives possible but
+// negligible.
+package breach
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	magic       = "PWNDIDX1"
+	fanoutSize  = 1 << 16
+	headerSize  = len(magic) + fanoutSize*8
+	entrySize   = 8
+	maxLineSize = 1024
+)
+
+var (
+	ErrInvalidIndex = errors.New("invalid breach index")
+	ErrUnsorted     = errors.New("breach dump is not sorted by hash")
+)
+
+// Index is an open breach index. It is safe for concurrent use.
+type Index struct {
+	file   *os.File
+	fanout [fanoutSize]uint64
+}
+
+// Open opens an index written by Build.
+func Open(path string) (*Index, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &Index{file: file}
+
+	header := make([]byte, headerSize)
+
+	_, err = io.ReadFull(file, header)
+	if err != nil || string(header[:len(magic)]) != magic {
+		file.Close()
+		return nil, ErrInvalidIndex
+	}
+
+	for i := range index.fanout {
+		index.fanout[i] = binary.BigEndian.Uint64(header[len(magic)+i*8:])
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if info.Size() != int64(headerSize)+int64(index.Len())*entrySize {
+		file.Close()
+		return nil, ErrInvalidIndex
+	}
+
+	return index, nil
+}
+
+func (idx *Index) Close() error {
+	return idx.file.Close()
+}
+
+// Len returns the number of hashes in the index.
+func (idx *Index) Len() uint64 {
+	return idx.fanout[fanoutSize-1]
+}
+
+// Contains reports whether the password appears in the corpus.
+func (idx *Index) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	key := binary.BigEndian.Uint64(sum[:8])
+
+	bucket := key >> 48
+
+	var lo uint64
+	if bucket > 0 {
+		lo = idx.fanout[bucket-1]
+	}
+	hi := idx.fanout[bucket]
+
+	entry := make([]byte, entrySize)
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		_, err := idx.file.ReadAt(entry, int64(headerSize)+int64(mid)*entrySize)
+		if err != nil {
+			return false, err
+		}
+
+		value := binary.BigEndian.Uint64(entry)
+
+		switch {
+		case value == key:
+			return true, nil
+		case value < key:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+// Build reads a dump of hex SHA-1 hashes sorted by hash, one per line in the
+// "HASH:COUNT" format of the Pwned Passwords downloads, and writes an index to
+// w. Hashes seen fewer than minCount times are left out. It returns the
+// number of indexed hashes.
+func Build(w io.WriteSeeker, r io.Reader, minCount int) (uint64, error) {
+	_, err := w.Write(make([]byte, headerSize))
+	if err != nil {
+		return 0, err
+	}
+
+	var fanout [fanoutSize]uint64
+	var count, previous uint64
+
+	out := bufio.NewWriter(w)
+	entry := make([]byte, entrySize)
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, maxLineSize), maxLineSize)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		hash, countText, _ := strings.Cut(text, ":")
+
+		if len(hash) != 2*sha1.Size {
+			return 0, fmt.Errorf("line %d: invalid hash", line)
+		}
+
+		prefix, err := hex.DecodeString(hash[:2*entrySize])
+		if err != nil {
+			return 0, fmt.Errorf("line %d: invalid hash", line)
+		}
+
+		if minCount > 1 && countText != "" {
+			seen, err := strconv.Atoi(countText)
+			if err != nil {
+				return 0, fmt.Errorf("line %d: invalid count", line)
+			}
+
+			if seen < minCount {
+				continue
+			}
+		}
+
+		key := binary.BigEndian.Uint64(prefix)
+
+		if count > 0 && key < previous {
+			return 0, fmt.Errorf("line %d: %w", line, ErrUnsorted)
+		}
+
+		// distinct hashes may share a prefix
+		if count > 0 && key == previous {
+			continue
+		}
+
+		binary.BigEndian.PutUint64(entry, key)
+
+		_, err = out.Write(entry)
+		if err != nil {
+			return 0, err
+		}
+
+		fanout[key>>48]++
+		count++
+		previous = key
+	}
+
+	if err = scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if err = out.Flush(); err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, headerSize)
+	copy(header, magic)
+
+	var total uint64
+	for i, n := range fanout {
+		total += n
+		binary.BigEndian.PutUint64(header[len(magic)+i*8:], total)
+	}
+
+	_, err = w.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = w.Write(header)
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
@@ -0,0 +1,258 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// FailedAttemptModel counts failed credential checks per key, such as an
+// account or an IP address. Counters live in Redis when it is configured and
+// reachable, and in Postgres otherwise. A counter starts over once window has
+// passed since its last failure.
+type FailedAttemptModel struct {
+	DB    *sql.DB
+	Redis *redis.Client
+}
+
+func failedAttemptKey(key string) string {
+	return "failed-attempts:" + key
+}
+
+// Record counts a failure for the key and returns the number of failures in
+// the current window, this one included, along with the time of the failure
+// before it. Recording first and deciding on the returned count keeps
+// parallel attempts from all passing a check made before any of them counts.
+// Failures recorded in Postgres during a Redis outage still count.
+func (m FailedAttemptModel) Record(key string, window time.Duration) (int, time.Time, error) {
+	if m.Redis != nil {
+		count, previous, err := m.recordRedis(key, window)
+		if err == nil {
+			outageCount, outageLast, err := m.getPostgres(key, window)
+			if err != nil || outageCount == 0 {
+				return count, previous, nil
+			}
+
+			if outageLast.After(previous) {
+				previous = outageLast
+			}
+
+			return max(count, outageCount+1), previous, nil
+		}
+	}
+
+	query := `
+		WITH previous AS (
+			SELECT last_failed_at
+			FROM failed_attempts
+			WHERE key = $1
+			FOR UPDATE
+		)
+		INSERT INTO failed_attempts (key, count, last_failed_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (key) DO UPDATE
+		SET count = CASE
+				WHEN failed_attempts.last_failed_at < $3 THEN 1
+				ELSE failed_attempts.count + 1
+			END,
+			last_failed_at = EXCLUDED.last_failed_at
+		RETURNING count, (SELECT last_failed_at FROM previous)`
+
+	now := time.Now()
+	args := []any{key, now, now.Add(-window)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	var previous sql.NullTime
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&count, &previous)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return count, previous.Time, nil
+}
+
+func (m FailedAttemptModel) recordRedis(key string, window time.Duration) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	var previous *redis.StringCmd
+	var count *redis.IntCmd
+
+	_, err := m.Redis.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		previous = pipe.HGet(ctx, failedAttemptKey(key), "last")
+		count = pipe.HIncrBy(ctx, failedAttemptKey(key), "count", 1)
+		pipe.HSet(ctx, failedAttemptKey(key), "last", time.Now().UnixMilli())
+		pipe.Expire(ctx, failedAttemptKey(key), window)
+		return nil
+	})
+	// a missing key means this is the first failure in the window
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, time.Time{}, err
+	}
+
+	var last time.Time
+
+	if previous.Val() != "" {
+		millis, err := strconv.ParseInt(previous.Val(), 10, 64)
+		if err != nil {
+			return 0, time.Time{}, err
+		}
+
+		last = time.UnixMilli(millis)
+	}
+
+	return int(count.Val()), last, nil
+}
+
+// refundScript takes a failure back from a Redis counter that still exists,
+// so that a counter that expired or was reset in the meantime is not revived.
+var refundScript = redis.NewScript(`
+if tonumber(redis.call("HGET", KEYS[1], "count") or "0") > 0 then
+	return redis.call("HINCRBY", KEYS[1], "count", -1)
+end
+return 0`)
+
+// Refund takes back a failure recorded for an attempt that turned out not to
+// have failed. The time of the last failure is kept.
+func (m FailedAttemptModel) Refund(key string) error {
+	if m.Redis != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		err := refundScript.Run(ctx, m.Redis, []string{failedAttemptKey(key)}).Err()
+		cancel()
+
+		if err == nil {
+			return nil
+		}
+	}
+
+	query := `
+		UPDATE failed_attempts
+		SET count = count - 1
+		WHERE key = $1 AND count > 0`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// Get returns the number of failures for the key in the current window and
+// the time of the last one. Failures recorded in Postgres during a Redis
+// outage still count once Redis is back, so the higher count and the later
+// failure of both stores win.
+func (m FailedAttemptModel) Get(key string, window time.Duration) (int, time.Time, error) {
+	count, last, err := m.getPostgres(key, window)
+	if m.Redis == nil {
+		return count, last, err
+	}
+
+	redisCount, redisLast, redisErr := m.getRedis(key)
+	switch {
+	case redisErr != nil:
+		return count, last, err
+	case err != nil:
+		return redisCount, redisLast, nil
+	}
+
+	if redisLast.After(last) {
+		last = redisLast
+	}
+
+	return max(count, redisCount), last, nil
+}
+
+func (m FailedAttemptModel) getPostgres(key string, window time.Duration) (int, time.Time, error) {
+	query := `
+		SELECT count, last_failed_at
+		FROM failed_attempts
+		WHERE key = $1 AND last_failed_at >= $2`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	var last time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, key, time.Now().Add(-window)).Scan(&count, &last)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, time.Time{}, nil
+		default:
+			return 0, time.Time{}, err
+		}
+	}
+
+	return count, last, nil
+}
+
+func (m FailedAttemptModel) getRedis(key string) (int, time.Time, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	values, err := m.Redis.HMGet(ctx, failedAttemptKey(key), "count", "last").Result()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	// a missing key means no failures in the window
+	countText, _ := values[0].(string)
+	lastText, _ := values[1].(string)
+	if countText == "" || lastText == "" {
+		return 0, time.Time{}, nil
+	}
+
+	count, err := strconv.Atoi(countText)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	last, err := strconv.ParseInt(lastText, 10, 64)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	return count, time.UnixMilli(last), nil
+}
+
+// Reset clears the failures of the key in both stores.
+func (m FailedAttemptModel) Reset(key string) error {
+	if m.Redis != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		m.Redis.Del(ctx, failedAttemptKey(key))
+		cancel()
+	}
+
+	query := `
+		DELETE FROM failed_attempts
+		WHERE key = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
+
+// DeleteExpired removes counters whose window has passed.
+func (m FailedAttemptModel) DeleteExpired(ctx context.Context, window time.Duration) (int64, error) {
+	query := `
+		DELETE FROM failed_attempts
+		WHERE last_failed_at < $1`
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now().Add(-window))
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
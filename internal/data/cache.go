@@ -0,0 +1,168 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TokenCache is a read-through cache of token lookups in Redis, keyed by the
+// token hash. Redis errors are treated as cache misses, so lookups fall back
+// to Postgres while Redis is unavailable. A nil cache caches nothing.
+type TokenCache struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+func NewTokenCache(client *redis.Client, ttl time.Duration) *TokenCache {
+	return &TokenCache{client: client, ttl: ttl}
+}
+
+type cachedToken struct {
+	UserID      int64     `json:"user_id"`
+	Expiry      time.Time `json:"expiry"`
+	Scope       string    `json:"scope"`
+	SessionID   string    `json:"session_id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Client      string    `json:"client"`
+	UserAgent   string    `json:"user_agent"`
+	LastUsedAt  time.Time `json:"last_used_at"`
+	AuthMethods []string  `json:"auth_methods"`
+	AuthTime    time.Time `json:"auth_time"`
+}
+
+// An evicted token is replaced by a tombstone for tombstoneTTL rather than
+// deleted. A lookup that read the token just before it was revoked writes it
+// back only if the key is free, so the tombstone keeps the revoked token out
+// of the cache; lookups finish well within the TTL.
+const (
+	tombstone    = "evicted"
+	tombstoneTTL = 10 * time.Second
+)
+
+func tokenCacheKey(hash []byte) string {
+	return "token:" + hex.EncodeToString(hash)
+}
+
+func (c *TokenCache) Get(hash []byte) (*Token, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	value, err := c.client.Get(ctx, tokenCacheKey(hash)).Bytes()
+	if err != nil || string(value) == tombstone {
+		return nil, false
+	}
+
+	var cached cachedToken
+
+	err = json.Unmarshal(value, &cached)
+	if err != nil || !cached.Expiry.After(time.Now()) {
+		return nil, false
+	}
+
+	return &Token{
+		Hash:        hash,
+		UserID:      cached.UserID,
+		Expiry:      cached.Expiry,
+		Scope:       cached.Scope,
+		SessionID:   cached.SessionID,
+		CreatedAt:   cached.CreatedAt,
+		Client:      cached.Client,
+		UserAgent:   cached.UserAgent,
+		LastUsedAt:  cached.LastUsedAt,
+		AuthMethods: cached.AuthMethods,
+		AuthTime:    cached.AuthTime,
+	}, true
+}
+
+// Set caches the token for the cache ttl, or until the token expires if that
+// comes first. It does nothing while the token is cached or was just evicted.
+func (c *TokenCache) Set(token *Token) {
+	if c == nil {
+		return
+	}
+
+	ttl := min(c.ttl, time.Until(token.Expiry))
+	if ttl <= 0 {
+		return
+	}
+
+	value, err := json.Marshal(cachedToken{
+		UserID:      token.UserID,
+		Expiry:      token.Expiry,
+		Scope:       token.Scope,
+		SessionID:   token.SessionID,
+		CreatedAt:   token.CreatedAt,
+		Client:      token.Client,
+		UserAgent:   token.UserAgent,
+		LastUsedAt:  token.LastUsedAt,
+		AuthMethods: token.AuthMethods,
+		AuthTime:    token.AuthTime,
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	c.client.SetNX(ctx, tokenCacheKey(token.Hash), value, ttl)
+}
+
+// Delete evicts the tokens, leaving a tombstone in their place.
+func (c *TokenCache) Delete(hashes ...[]byte) {
+	if c == nil || len(hashes) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	c.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, hash := range hashes {
+			pipe.Set(ctx, tokenCacheKey(hash), tombstone, tombstoneTTL)
+		}
+
+		return nil
+	})
+}
+
+// execEvicting runs a statement that returns the hash of every token it
+// changes or deletes, evicts those tokens from the cache and returns how many
+// there were.
+func execEvicting(ctx context.Context, db *sql.DB, cache *TokenCache, query string, args ...any) (int64, error) {
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var hashes [][]byte
+
+	for rows.Next() {
+		var hash []byte
+
+		err := rows.Scan(&hash)
+		if err != nil {
+			return 0, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	cache.Delete(hashes...)
+
+	return int64(len(hashes)), nil
+}
@@ -0,0 +1,44 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+)
+
+var (
+	ErrLockHeld = errors.New("lock held by another process")
+)
+
+// Keys of the Postgres advisory locks that keep background jobs to a single
+// replica at a time.
+const (
+	lockTokenReaper int64 = 40020001
+)
+
+// withAdvisoryLock runs fn on a dedicated connection while holding the
+// session level advisory lock, or returns ErrLockHeld when another session
+// holds it.
+func withAdvisoryLock(ctx context.Context, db *sql.DB, key int64, fn func(conn *sql.Conn) error) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var locked bool
+
+	err = conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked)
+	if err != nil {
+		return err
+	}
+
+	if !locked {
+		return ErrLockHeld
+	}
+
+	// the lock belongs to the session, so release it even if ctx is done
+	defer conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock($1)`, key)
+
+	return fn(conn)
+}
@@ -3,6 +3,9 @@ package data
 import (
 	"database/sql"
 	"errors"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/saarwasserman/auth/internal/hasher"
 )
 
 var (
@@ -11,17 +14,31 @@ var (
 )
 
 type Models struct {
-	Passwords   PasswordModel
-	Permissions PermissionModel
-	Tokens      TokenModel
-	Users       UserModel
+	FailedAttempts    FailedAttemptModel
+	Passkeys          PasskeyModel
+	PasskeyChallenges PasskeyChallengeModel
+	Passwords         PasswordModel
+	Permissions       PermissionModel
+	RecoveryCodes     RecoveryCodeModel
+	Sessions          SessionModel
+	SigningKeys       SigningKeyModel
+	Tokens            TokenModel
+	Totp              TotpModel
+	Users             UserModel
 }
 
-func NewModels(db *sql.DB) Models {
+func NewModels(db *sql.DB, redisClient *redis.Client, tokenScopes map[string]TokenScope, tokenCache *TokenCache, passwordHasher *hasher.Hasher, peppers *hasher.Peppers, passwordHistorySize int, totpKey, signingKeyKey []byte) Models {
 	return Models{
-		Passwords:   PasswordModel{DB: db},
-		Permissions: PermissionModel{DB: db},
-		Tokens:      TokenModel{DB: db},
-		Users:       UserModel{DB: db},
+		FailedAttempts:    FailedAttemptModel{DB: db, Redis: redisClient},
+		Passkeys:          PasskeyModel{DB: db},
+		PasskeyChallenges: PasskeyChallengeModel{Redis: redisClient},
+		Passwords:         PasswordModel{DB: db, Hasher: passwordHasher, Peppers: peppers, HistorySize: passwordHistorySize},
+		Permissions:       PermissionModel{DB: db},
+		RecoveryCodes:     RecoveryCodeModel{DB: db},
+		Sessions:          SessionModel{DB: db, Cache: tokenCache},
+		SigningKeys:       SigningKeyModel{DB: db, Key: signingKeyKey},
+		Tokens:            TokenModel{DB: db, Scopes: tokenScopes, Cache: tokenCache},
+		Totp:              TotpModel{DB: db, Key: totpKey},
+		Users:             UserModel{DB: db, Cache: tokenCache},
 	}
 }
@@ -0,0 +1,206 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	ErrDuplicatePasskey  = errors.New("duplicate passkey")
+	ErrSignCountReplayed = errors.New("passkey sign count did not increase")
+	ErrMissingCache      = errors.New("cache not configured")
+)
+
+// Passkey is a WebAuthn credential registered by a user. Only its public key
+// is stored; the private key never leaves the authenticator.
+type Passkey struct {
+	ID              []byte
+	UserID          int64
+	PublicKey       []byte
+	AttestationType string
+	Transports      []string
+	AAGUID          []byte
+	SignCount       uint32
+	BackupEligible  bool
+	BackupState     bool
+	CreatedAt       time.Time
+}
+
+type PasskeyModel struct {
+	DB *sql.DB
+}
+
+// Insert stores a newly registered passkey. It returns ErrDuplicatePasskey if
+// the credential is registered already, to this or another user.
+func (m PasskeyModel) Insert(ctx context.Context, passkey *Passkey) error {
+	query := `
+		INSERT INTO passkeys (id, user_id, public_key, attestation_type, transports, aaguid, sign_count, backup_eligible, backup_state)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING created_at`
+
+	args := []any{
+		passkey.ID,
+		passkey.UserID,
+		passkey.PublicKey,
+		passkey.AttestationType,
+		pq.Array(passkey.Transports),
+		passkey.AAGUID,
+		int64(passkey.SignCount),
+		passkey.BackupEligible,
+		passkey.BackupState,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&passkey.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "passkeys_pkey"`:
+			return ErrDuplicatePasskey
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetAllForUser returns the user's passkeys, oldest first.
+func (m PasskeyModel) GetAllForUser(ctx context.Context, userID int64) ([]*Passkey, error) {
+	query := `
+		SELECT id, user_id, public_key, attestation_type, transports, aaguid, sign_count, backup_eligible, backup_state, created_at
+		FROM passkeys
+		WHERE user_id = $1
+		ORDER BY created_at, id`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	passkeys := []*Passkey{}
+
+	for rows.Next() {
+		var passkey Passkey
+		var signCount int64
+
+		err := rows.Scan(
+			&passkey.ID,
+			&passkey.UserID,
+			&passkey.PublicKey,
+			&passkey.AttestationType,
+			pq.Array(&passkey.Transports),
+			&passkey.AAGUID,
+			&signCount,
+			&passkey.BackupEligible,
+			&passkey.BackupState,
+			&passkey.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		passkey.SignCount = uint32(signCount)
+		passkeys = append(passkeys, &passkey)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return passkeys, nil
+}
+
+// Use records an assertion made with the passkey. The sign count must have
+// increased since the last one, unless the authenticator does not count at
+// all, or ErrSignCountReplayed is returned: the assertion was replayed or
+// the authenticator cloned.
+func (m PasskeyModel) Use(ctx context.Context, id []byte, signCount uint32, backupState bool) error {
+	query := `
+		UPDATE passkeys
+		SET sign_count = $2, backup_state = $3, last_used_at = NOW()
+		WHERE id = $1 AND (sign_count < $2 OR (sign_count = 0 AND $2 = 0))`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, int64(signCount), backupState)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrSignCountReplayed
+	}
+
+	return nil
+}
+
+// PasskeyChallengeModel keeps the state of WebAuthn ceremonies in progress,
+// including their challenges, in Redis. Each one can be taken only once.
+type PasskeyChallengeModel struct {
+	Redis *redis.Client
+}
+
+func passkeyChallengeKey(ceremony, id string) string {
+	return "passkey-challenge:" + ceremony + ":" + id
+}
+
+// Save stores the state of a new ceremony for ttl and returns its id.
+func (m PasskeyChallengeModel) Save(ctx context.Context, ceremony string, state []byte, ttl time.Duration) (string, error) {
+	if m.Redis == nil {
+		return "", ErrMissingCache
+	}
+
+	id, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+
+	err = m.Redis.Set(ctx, passkeyChallengeKey(ceremony, id), state, ttl).Err()
+	if err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Take returns and removes the state of a ceremony, or ErrRecordNotFound if
+// it is unknown, expired or taken already.
+func (m PasskeyChallengeModel) Take(ctx context.Context, ceremony, id string) ([]byte, error) {
+	if m.Redis == nil {
+		return nil, ErrMissingCache
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+
+	state, err := m.Redis.GetDel(ctx, passkeyChallengeKey(ceremony, id)).Bytes()
+	if err != nil {
+		switch {
+		case errors.Is(err, redis.Nil):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return state, nil
+}
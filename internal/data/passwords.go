@@ -5,69 +5,286 @@ import (
 	"database/sql"
 	"errors"
 	"time"
+
+	"github.com/saarwasserman/auth/internal/hasher"
 )
 
+// PasswordModel is the repository of password credentials, kept in the
+// credentials table with one row per user. Every query runs under the
+// caller's context, bounded by a 3 second timeout.
 type PasswordModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Hasher  *hasher.Hasher
+	Peppers *hasher.Peppers
+	// HistorySize is the number of a user's recent password hashes that are
+	// kept to prevent reuse. Zero disables the history.
+	HistorySize int
+}
+
+// Hash peppers the plaintext password with the current pepper and hashes it.
+// The returned pepper version must be stored along with the hash.
+func (m PasswordModel) Hash(plaintextPassword string) (string, int, error) {
+	peppered, err := m.Peppers.Apply(m.Peppers.Current, plaintextPassword)
+	if err != nil {
+		return "", 0, err
+	}
+
+	hash, err := m.Hasher.Hash(peppered)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return hash, m.Peppers.Current, nil
 }
 
-func (m PasswordModel) GetPasswordForUserId(userID int64) (string, error) {
+// GetPasswordForUserId returns the user's password hash and the version of
+// the pepper it was made with, or ErrRecordNotFound if the user has no
+// credentials.
+func (m PasswordModel) GetPasswordForUserId(ctx context.Context, userID int64) (string, int, error) {
 	query := `
-		SELECT password_hash
-		FROM passwords
+		SELECT password_hash, pepper_version
+		FROM credentials
 		WHERE user_id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	var password_hash string
+	var pepper_version int
 
-	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&password_hash)
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&password_hash, &pepper_version)
 	if err != nil {
-		return "", err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return "", 0, ErrRecordNotFound
+		default:
+			return "", 0, err
+		}
 	}
 
-	return password_hash, nil
+	return password_hash, pepper_version, nil
 }
 
-func (m PasswordModel) CreatePasswordForUserId(userID int64, password_hash []byte) error {
+// ChangedAt returns when the user last set a new password. Rehashing an
+// unchanged password does not count as a change.
+func (m PasswordModel) ChangedAt(ctx context.Context, userID int64) (time.Time, error) {
 	query := `
-		INSERT INTO credentials (user_id, password_hash)
-		VALUES ($1, $2)`
+		SELECT password_changed_at
+		FROM credentials
+		WHERE user_id = $1`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, password_hash)
+	var changedAt time.Time
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&changedAt)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return ErrRecordNotFound
+			return time.Time{}, ErrRecordNotFound
 		default:
+			return time.Time{}, err
+		}
+	}
+
+	return changedAt, nil
+}
+
+// Matches checks the plaintext password against the user's credentials. A
+// user without credentials is checked against a placeholder hash, so that an
+// unknown user takes about as long to reject as a wrong password. needsRehash
+// reports a match against a hash made with an outdated algorithm, outdated
+// parameters or an outdated pepper.
+func (m PasswordModel) Matches(ctx context.Context, userID int64, plaintextPassword string) (match bool, needsRehash bool, err error) {
+	found := true
+
+	hash, pepperVersion, err := m.GetPasswordForUserId(ctx, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrRecordNotFound):
+			found = false
+			pepperVersion = m.Peppers.Current
+
+			hash, err = m.Hasher.Placeholder()
+			if err != nil {
+				return false, false, err
+			}
+		default:
+			return false, false, err
+		}
+	}
+
+	peppered, err := m.Peppers.Apply(pepperVersion, plaintextPassword)
+	if err != nil {
+		return false, false, err
+	}
+
+	match, needsRehash, err = m.Hasher.Verify(peppered, hash)
+	if err != nil {
+		return false, false, err
+	}
+
+	needsRehash = needsRehash || pepperVersion != m.Peppers.Current
+
+	return found && match, found && match && needsRehash, nil
+}
+
+// SetPasswordForUserId stores a new password hash for the user, creating the
+// credentials or replacing the existing ones. The replaced hash is added to
+// the user's password history, which is pruned to HistorySize entries, so
+// that together with the current password HistorySize previous ones are
+// remembered.
+func (m PasswordModel) SetPasswordForUserId(ctx context.Context, userID int64, password_hash string, pepper_version int) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// with the history disabled, the entries kept so far are left alone
+	if m.HistorySize > 0 {
+		query := `
+			INSERT INTO password_history (user_id, password_hash, pepper_version)
+			SELECT user_id, password_hash, pepper_version
+			FROM credentials
+			WHERE user_id = $1`
+
+		_, err = tx.ExecContext(ctx, query, userID)
+		if err != nil {
+			return err
+		}
+
+		query = `
+			DELETE FROM password_history
+			WHERE user_id = $1 AND id NOT IN (
+				SELECT id
+				FROM password_history
+				WHERE user_id = $1
+				ORDER BY id DESC
+				LIMIT $2
+			)`
+
+		_, err = tx.ExecContext(ctx, query, userID, m.HistorySize)
+		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	query := `
+		INSERT INTO credentials (user_id, password_hash, pepper_version)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET password_hash = EXCLUDED.password_hash, pepper_version = EXCLUDED.pepper_version, password_changed_at = NOW()`
+
+	_, err = tx.ExecContext(ctx, query, userID, []byte(password_hash), pepper_version)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-func (m PasswordModel) UpdatePasswordForUserId(userID int64, password_hash string) error {
+// MatchesHistory reports whether the plaintext password matches the user's
+// current password or one of the passwords in the history. The current
+// password is checked even with the history disabled, so that a password
+// change cannot keep it. Hashes peppered with a retired pepper can no longer
+// be checked and are skipped.
+func (m PasswordModel) MatchesHistory(ctx context.Context, userID int64, plaintextPassword string) (bool, error) {
 	query := `
-		UPDATE credentials
-		SET password_hash = $1
-		WHERE user_id = $2`
+		SELECT password_hash, pepper_version
+		FROM credentials
+		WHERE user_id = $1
+		UNION ALL (
+			SELECT password_hash, pepper_version
+			FROM password_history
+			WHERE user_id = $1
+			ORDER BY id DESC
+			LIMIT $2
+		)`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, password_hash, userID).Err()
+	rows, err := m.DB.QueryContext(ctx, query, userID, max(m.HistorySize, 0))
 	if err != nil {
-		switch {
-		case errors.Is(err, sql.ErrNoRows):
-			return ErrRecordNotFound
-		default:
-			return err
+		return false, err
+	}
+	defer rows.Close()
+
+	type previousPassword struct {
+		hash          string
+		pepperVersion int
+	}
+
+	var previous []previousPassword
+
+	for rows.Next() {
+		var password previousPassword
+
+		err := rows.Scan(&password.hash, &password.pepperVersion)
+		if err != nil {
+			return false, err
 		}
+
+		previous = append(previous, password)
+	}
+
+	if err = rows.Err(); err != nil {
+		return false, err
+	}
+
+	for _, password := range previous {
+		peppered, err := m.Peppers.Apply(password.pepperVersion, plaintextPassword)
+		if err != nil {
+			if errors.Is(err, hasher.ErrUnknownPepperVersion) {
+				continue
+			}
+
+			return false, err
+		}
+
+		match, _, err := m.Hasher.Verify(peppered, password.hash)
+		if err != nil {
+			return false, err
+		}
+
+		if match {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// UpdatePasswordForUserId replaces the hash of the user's unchanged password,
+// e.g. after rehashing it with newer parameters. It neither counts as a
+// password change nor enters the history, and it returns ErrRecordNotFound if
+// the user has no credentials.
+func (m PasswordModel) UpdatePasswordForUserId(ctx context.Context, userID int64, password_hash string, pepper_version int) error {
+	query := `
+		UPDATE credentials
+		SET password_hash = $1, pepper_version = $2
+		WHERE user_id = $3`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, []byte(password_hash), pepper_version, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
 	}
 
 	return nil
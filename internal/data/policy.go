@@ -0,0 +1,184 @@
+package data
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/nbutton23/zxcvbn-go"
+	"github.com/saarwasserman/auth/internal/validator"
+)
+
+// PasswordPolicy holds the rules a new password must satisfy. Each rule is
+// reported under its own key, so that every failed rule can be shown.
+type PasswordPolicy struct {
+	MinLength int
+	MaxLength int
+	// MinCharacterClasses is the number of classes out of lowercase,
+	// uppercase, digits and symbols that must appear. Zero disables the rule.
+	MinCharacterClasses int
+	// MaxRepeatedCharacters is the longest allowed run of one character. Zero
+	// disables the rule.
+	MaxRepeatedCharacters int
+	// ForbidPersonalInfo rejects passwords that contain the user's email or
+	// name.
+	ForbidPersonalInfo bool
+	// MinStrength is the minimum zxcvbn score, from 0 to 4.
+	MinStrength int
+	// DenyList holds lowercased passwords that are never accepted.
+	DenyList map[string]struct{}
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:          8,
+	MaxLength:          1024,
+	ForbidPersonalInfo: true,
+}
+
+func ValidatePasswordPolicy(v *validator.Validator, policy PasswordPolicy) {
+	v.Check(policy.MinLength >= 1, "min_length", "must be at least 1")
+	v.Check(policy.MaxLength >= policy.MinLength, "max_length", "must not be less than the minimum length")
+	v.Check(policy.MaxLength <= 1024, "max_length", "must not be more than 1024")
+	v.Check(policy.MinCharacterClasses >= 0 && policy.MinCharacterClasses <= 4, "min_character_classes", "must be between 0 and 4")
+	v.Check(policy.MaxRepeatedCharacters >= 0, "max_repeated_characters", "must not be negative")
+	v.Check(policy.MinStrength >= 0 && policy.MinStrength <= 4, "min_strength", "must be between 0 and 4")
+}
+
+// LoadDenyList reads a file with one denied password per line. Blank lines
+// are skipped.
+func LoadDenyList(path string) (map[string]struct{}, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	denyList := make(map[string]struct{})
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		denyList[strings.ToLower(line)] = struct{}{}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return denyList, nil
+}
+
+// Validate checks the password against every rule of the policy and records
+// each violation under key.<rule>. The user, when known, feeds the personal
+// information and strength rules.
+func (p PasswordPolicy) Validate(v *validator.Validator, key, password string, user *User) {
+	if password == "" {
+		v.AddError(key, "must be provided")
+		return
+	}
+
+	v.Check(len(password) >= p.MinLength, key+".min_length", fmt.Sprintf("must be at least %d bytes long", p.MinLength))
+	v.Check(len(password) <= p.MaxLength, key+".max_length", fmt.Sprintf("must not be more than %d bytes long", p.MaxLength))
+
+	if p.MinCharacterClasses > 0 {
+		v.Check(characterClasses(password) >= p.MinCharacterClasses, key+".character_classes",
+			fmt.Sprintf("must contain at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinCharacterClasses))
+	}
+
+	if p.MaxRepeatedCharacters > 0 {
+		v.Check(longestRun(password) <= p.MaxRepeatedCharacters, key+".repeated_characters",
+			fmt.Sprintf("must not repeat a character more than %d times in a row", p.MaxRepeatedCharacters))
+	}
+
+	var userInputs []string
+	if user != nil {
+		userInputs = personalInfo(user)
+	}
+
+	if p.ForbidPersonalInfo {
+		lowered := strings.ToLower(password)
+		for _, input := range userInputs {
+			if strings.Contains(lowered, input) {
+				v.AddError(key+".personal_info", "must not contain your email or name")
+				break
+			}
+		}
+	}
+
+	if _, denied := p.DenyList[strings.ToLower(password)]; denied {
+		v.AddError(key+".deny_list", "is too common")
+	}
+
+	// zxcvbn is slow on long inputs and long passwords are strong anyway
+	if p.MinStrength > 0 && len(password) <= 100 {
+		score := zxcvbn.PasswordStrength(password, userInputs).Score
+		v.Check(score >= p.MinStrength, key+".strength", "is too easy to guess")
+	}
+}
+
+func characterClasses(password string) int {
+	var lower, upper, digit, symbol int
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+
+	return lower + upper + digit + symbol
+}
+
+func longestRun(password string) int {
+	longest, run := 0, 0
+	var previous rune
+
+	for i, r := range []rune(password) {
+		if i > 0 && r == previous {
+			run++
+		} else {
+			run = 1
+		}
+
+		previous = r
+		longest = max(longest, run)
+	}
+
+	return longest
+}
+
+// personalInfo returns the lowercased parts of the user's email and name that
+// are long enough to be meaningful inside a password.
+func personalInfo(user *User) []string {
+	var inputs []string
+
+	email := strings.ToLower(user.Email)
+	if email != "" {
+		inputs = append(inputs, email)
+
+		local, _, _ := strings.Cut(email, "@")
+		if len(local) >= 3 {
+			inputs = append(inputs, local)
+		}
+	}
+
+	for _, part := range strings.Fields(strings.ToLower(user.Name)) {
+		if len(part) >= 3 {
+			inputs = append(inputs, part)
+		}
+	}
+
+	return inputs
+}
@@ -0,0 +1,124 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// RecoveryCodeCount is the number of recovery codes in a set.
+const RecoveryCodeCount = 10
+
+// NewRecoveryCodes returns a set of random recovery codes of 80 bits each,
+// formatted for reading as XXXX-XXXX-XXXX-XXXX.
+func NewRecoveryCodes() ([]string, error) {
+	codes := make([]string, RecoveryCodeCount)
+
+	for i := range codes {
+		code, err := randomString(10)
+		if err != nil {
+			return nil, err
+		}
+
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+	}
+
+	return codes, nil
+}
+
+// recoveryCodeHash hashes a recovery code the way token plaintexts are
+// hashed, ignoring case, separators and spaces.
+func recoveryCodeHash(code string) []byte {
+	normalized := strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
+
+// RecoveryCodeModel stores the hashes of single-use MFA recovery codes.
+type RecoveryCodeModel struct {
+	DB *sql.DB
+}
+
+// ReplaceForUser stores a new set of codes for the user, invalidating the
+// previous set.
+func (m RecoveryCodeModel) ReplaceForUser(ctx context.Context, userID int64, codes []string) error {
+	hashes := make([][]byte, len(codes))
+	for i, code := range codes {
+		hashes[i] = recoveryCodeHash(code)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM recovery_codes
+		WHERE user_id = $1`
+
+	_, err = tx.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	query = `
+		INSERT INTO recovery_codes (hash, user_id)
+		SELECT hash, $1 FROM UNNEST($2::bytea[]) AS hash`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.ByteaArray(hashes))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Consume spends one of the user's unused codes. A code that is unknown,
+// belongs to another user or was used already gives ErrRecordNotFound.
+func (m RecoveryCodeModel) Consume(ctx context.Context, userID int64, code string) error {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = NOW()
+		WHERE hash = $1 AND user_id = $2 AND used_at IS NULL`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, recoveryCodeHash(code), userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser removes the user's codes, used or not.
+func (m RecoveryCodeModel) DeleteAllForUser(ctx context.Context, userID int64) error {
+	query := `
+		DELETE FROM recovery_codes
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
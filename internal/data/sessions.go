@@ -0,0 +1,248 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var (
+	ErrSessionInactive = errors.New("session expired due to inactivity")
+	ErrSessionExpired  = errors.New("session expired")
+)
+
+// Authentication methods a session's user proved themselves with, as carried
+// in the amr of its tokens.
+const (
+	AuthMethodPassword     = "password"
+	AuthMethodTotp         = "totp"
+	AuthMethodRecoveryCode = "recovery-code"
+	AuthMethodPasskey      = "passkey"
+	AuthMethodEmail        = "email"
+)
+
+// Session groups the tokens issued from a single login, such as an access
+// token and the refresh tokens rotated from it. AuthMethods and AuthTime
+// describe that login and stay the same when tokens are refreshed.
+type Session struct {
+	ID          string    `json:"id"`
+	CreatedAt   time.Time `json:"created_at"`
+	Client      string    `json:"client"`
+	UserAgent   string    `json:"user_agent"`
+	Expiry      time.Time `json:"expiry"`
+	AuthMethods []string  `json:"auth_methods"`
+	AuthTime    time.Time `json:"auth_time"`
+}
+
+// SessionPolicy bounds how long a session lasts. Zero durations disable a
+// rule.
+type SessionPolicy struct {
+	// InactivityTime is how long an access token may go unused.
+	InactivityTime time.Duration
+	// MaxLifetime is how long a session lasts from login, however active.
+	MaxLifetime time.Duration
+}
+
+// CheckAccess checks an access or refresh token: its session must have been
+// used within the inactivity time, and must not have outlived MaxLifetime.
+func (p SessionPolicy) CheckAccess(token *Token, now time.Time) error {
+	if p.InactivityTime > 0 && now.Sub(token.LastUsedAt) > p.InactivityTime {
+		return ErrSessionInactive
+	}
+
+	return p.CheckLifetime(token, now)
+}
+
+// CheckLifetime checks only the age of the token's session.
+func (p SessionPolicy) CheckLifetime(token *Token, now time.Time) error {
+	if p.MaxLifetime > 0 && now.Sub(token.CreatedAt) > p.MaxLifetime {
+		return ErrSessionExpired
+	}
+
+	return nil
+}
+
+// AccessExpiry caps the expiry of a signed access token, which cannot be
+// tracked per use: it lapses after the inactivity time, as an idle opaque
+// token would, and never outlives its session.
+func (p SessionPolicy) AccessExpiry(session *Session, expiry, now time.Time) time.Time {
+	if p.InactivityTime > 0 && expiry.After(now.Add(p.InactivityTime)) {
+		expiry = now.Add(p.InactivityTime)
+	}
+
+	if p.MaxLifetime > 0 && expiry.After(session.CreatedAt.Add(p.MaxLifetime)) {
+		expiry = session.CreatedAt.Add(p.MaxLifetime)
+	}
+
+	return expiry
+}
+
+func NewSession(client, userAgent string) (*Session, error) {
+	id, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		ID:        id,
+		CreatedAt: time.Now(),
+		Client:    client,
+		UserAgent: userAgent,
+	}, nil
+}
+
+type SessionModel struct {
+	DB    *sql.DB
+	Cache *TokenCache
+}
+
+// GetAllForUser returns the user's sessions that still hold a usable token,
+// newest first.
+func (m SessionModel) GetAllForUser(userID int64) ([]*Session, error) {
+	query := `
+		SELECT session_id, created_at, client, user_agent, MAX(expiry)
+		FROM tokens
+		WHERE user_id = $1
+		AND scope IN ($2, $3)
+		AND expiry > $4
+		AND NOT used
+		GROUP BY session_id, created_at, client, user_agent
+		ORDER BY created_at DESC`
+
+	args := []any{userID, ScopeAuthentication, ScopeRefresh, time.Now()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []*Session{}
+
+	for rows.Next() {
+		var session Session
+
+		err := rows.Scan(
+			&session.ID,
+			&session.CreatedAt,
+			&session.Client,
+			&session.UserAgent,
+			&session.Expiry)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, &session)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+// Touch records activity on every token of the session whose last use is
+// older than the given threshold.
+func (m SessionModel) Touch(sessionID string, threshold time.Time) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = $1
+		WHERE session_id = $2 AND last_used_at < $3
+		RETURNING hash`
+
+	args := []any{time.Now(), sessionID, threshold}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := execEvicting(ctx, m.DB, m.Cache, query, args...)
+	return err
+}
+
+func (m SessionModel) Delete(sessionID string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE session_id = $1
+		RETURNING hash`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := execEvicting(ctx, m.DB, m.Cache, query, sessionID)
+	return err
+}
+
+// DeleteForUser revokes one of the user's sessions. Sessions of other users
+// are reported as not found.
+func (m SessionModel) DeleteForUser(userID int64, sessionID string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND session_id = $2 AND scope IN ($3, $4)
+		RETURNING hash`
+
+	args := []any{userID, sessionID, ScopeAuthentication, ScopeRefresh}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rowsAffected, err := execEvicting(ctx, m.DB, m.Cache, query, args...)
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUserExcept revokes every session of the user other than the
+// given one.
+func (m SessionModel) DeleteAllForUserExcept(userID int64, sessionID string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND session_id <> $2 AND scope IN ($3, $4)
+		RETURNING hash`
+
+	args := []any{userID, sessionID, ScopeAuthentication, ScopeRefresh}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := execEvicting(ctx, m.DB, m.Cache, query, args...)
+	return err
+}
+
+// DeleteOldestForUser evicts the user's oldest sessions so that at most keep
+// of them remain. Like GetAllForUser, it only counts sessions with a token
+// that is neither expired nor used; dead sessions are left to the reaper.
+func (m SessionModel) DeleteOldestForUser(userID int64, keep int) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND session_id IN (
+			SELECT session_id
+			FROM tokens
+			WHERE user_id = $1
+			AND scope IN ($2, $3)
+			AND expiry > $4
+			AND NOT used
+			GROUP BY session_id
+			ORDER BY MIN(created_at) DESC
+			OFFSET $5
+		)
+		RETURNING hash`
+
+	args := []any{userID, ScopeAuthentication, ScopeRefresh, time.Now(), keep}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := execEvicting(ctx, m.DB, m.Cache, query, args...)
+	return err
+}
@@ -0,0 +1,149 @@
+package data
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+var ErrMissingSigningKeyKey = errors.New("signing key encryption key not configured")
+
+// SigningKey is an Ed25519 key pair used to sign access tokens. A key signs
+// new tokens until a newer key is created, and keeps verifying tokens until it
+// expires.
+type SigningKey struct {
+	ID         string
+	PrivateKey ed25519.PrivateKey
+	PublicKey  ed25519.PublicKey
+	CreatedAt  time.Time
+	ExpiresAt  time.Time
+}
+
+func NewSigningKey(lifetime time.Duration) (*SigningKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := randomString(16)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &SigningKey{
+		ID:         id,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(lifetime),
+	}, nil
+}
+
+// SigningKeyModel stores private keys encrypted with AES-256-GCM under Key,
+// bound to the key id, so that a database dump alone cannot forge tokens.
+type SigningKeyModel struct {
+	DB  *sql.DB
+	Key []byte
+}
+
+func (m SigningKeyModel) Insert(key *SigningKey) error {
+	if len(m.Key) == 0 {
+		return ErrMissingSigningKeyKey
+	}
+
+	privateKey, err := seal(m.Key, key.PrivateKey, additionalData("signing-key", key.ID))
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO signing_keys (id, private_key, public_key, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	args := []any{
+		key.ID,
+		privateKey,
+		[]byte(key.PublicKey),
+		key.CreatedAt,
+		key.ExpiresAt,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetAllActive returns the keys that have not expired yet, newest first. It
+// fails with ErrInvalidCiphertext if a key was encrypted under another Key.
+func (m SigningKeyModel) GetAllActive() ([]*SigningKey, error) {
+	if len(m.Key) == 0 {
+		return nil, ErrMissingSigningKeyKey
+	}
+
+	query := `
+		SELECT id, private_key, public_key, created_at, expires_at
+		FROM signing_keys
+		WHERE expires_at > $1
+		ORDER BY created_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*SigningKey{}
+
+	for rows.Next() {
+		var key SigningKey
+		var privateKey, publicKey []byte
+
+		err := rows.Scan(
+			&key.ID,
+			&privateKey,
+			&publicKey,
+			&key.CreatedAt,
+			&key.ExpiresAt)
+		if err != nil {
+			return nil, err
+		}
+
+		privateKey, err = open(m.Key, privateKey, additionalData("signing-key", key.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		key.PrivateKey = ed25519.PrivateKey(privateKey)
+		key.PublicKey = ed25519.PublicKey(publicKey)
+
+		keys = append(keys, &key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+func (m SigningKeyModel) DeleteExpired() error {
+	query := `
+		DELETE FROM signing_keys
+		WHERE expires_at <= $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, time.Now())
+	return err
+}
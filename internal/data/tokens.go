@@ -7,74 +7,267 @@ import (
 	"database/sql"
 	"encoding/base32"
 	"errors"
+	"fmt"
+	"math"
+	"math/big"
 	"time"
 
+	"github.com/lib/pq"
 	"github.com/saarwasserman/auth/internal/validator"
 )
 
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeRefresh        = "refresh"
+	ScopePasswordReset  = "password-reset"
+	ScopeAPIKey         = "api-key"
+	ScopePasswordChange = "password-change"
+	ScopeMfaPending     = "mfa-pending"
+	ScopeLoginCode      = "login-code"
 )
 
+var (
+	ErrTokenReused       = errors.New("token reused")
+	ErrUnknownTokenScope = errors.New("unknown token scope")
+)
+
+// neverExpires is stored as the expiry of tokens whose scope has no ttl.
+var neverExpires = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+// TokenScope holds the settings shared by every token issued in a scope.
+type TokenScope struct {
+	// TTL is both the default and the maximum lifetime of a token. Zero means
+	// tokens never expire.
+	TTL time.Duration `json:"ttl"`
+	// Size is the number of random bytes in a token.
+	Size int `json:"size"`
+	// SingleUse tokens are consumed by the first successful lookup.
+	SingleUse bool `json:"single-use"`
+}
+
+var DefaultTokenScopes = map[string]TokenScope{
+	ScopeActivation:     {TTL: 3 * 24 * time.Hour, Size: 16},
+	ScopeAuthentication: {TTL: 24 * time.Hour, Size: 16},
+	ScopeRefresh:        {TTL: 30 * 24 * time.Hour, Size: 16, SingleUse: true},
+	ScopePasswordReset:  {TTL: 45 * time.Minute, Size: 16, SingleUse: true},
+	ScopeAPIKey:         {TTL: 0, Size: 32},
+	ScopePasswordChange: {TTL: 15 * time.Minute, Size: 16},
+	ScopeMfaPending:     {TTL: 5 * time.Minute, Size: 16},
+	ScopeLoginCode:      {TTL: 10 * time.Minute, Size: 16, SingleUse: true},
+}
+
+// Lifetime returns the ttl of a new token: the requested one when given,
+// capped by the scope's ttl.
+func (s TokenScope) Lifetime(requested time.Duration) time.Duration {
+	if requested <= 0 || (s.TTL > 0 && requested > s.TTL) {
+		return s.TTL
+	}
+
+	return requested
+}
+
+// PlaintextLength is the length of the base32 encoded plaintext of a token.
+func (s TokenScope) PlaintextLength() int {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodedLen(s.Size)
+}
+
+func ValidateTokenScope(v *validator.Validator, scope TokenScope) {
+	v.Check(scope.TTL >= 0, "ttl", "must not be negative")
+	v.Check(scope.Size >= 16, "size", "must be at least 16 bytes")
+	v.Check(scope.Size <= 64, "size", "must not be more than 64 bytes")
+}
+
 type Token struct {
-	Plaintext string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    int64     `json:"-"`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	Plaintext  string    `json:"token"`
+	Hash       []byte    `json:"-"`
+	UserID     int64     `json:"-"`
+	Expiry     time.Time `json:"expiry"`
+	Scope      string    `json:"-"`
+	SessionID  string    `json:"-"`
+	CreatedAt  time.Time `json:"-"`
+	Client     string    `json:"-"`
+	UserAgent  string    `json:"-"`
+	LastUsedAt time.Time `json:"-"`
+	// AuthMethods and AuthTime are those of the login the token's session
+	// started with. Tokens outside a session have none.
+	AuthMethods []string  `json:"-"`
+	AuthTime    time.Time `json:"-"`
+}
+
+// Session returns the session the token was issued for.
+func (t *Token) Session() *Session {
+	return &Session{
+		ID:          t.SessionID,
+		CreatedAt:   t.CreatedAt,
+		Client:      t.Client,
+		UserAgent:   t.UserAgent,
+		AuthMethods: t.AuthMethods,
+		AuthTime:    t.AuthTime,
+	}
+}
+
+func randomString(size int) (string, error) {
+	randomBytes := make([]byte, size)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
 }
 
-func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func generateToken(userID int64, ttl time.Duration, scope string, size int) (*Token, error) {
 	token := &Token{
 		UserID: userID,
 		Expiry: time.Now().Add(ttl),
 		Scope:  scope,
 	}
 
-	randomBytes := make([]byte, 16)
+	if ttl == 0 {
+		token.Expiry = neverExpires
+	}
 
-	_, err := rand.Read(randomBytes)
+	plaintext, err := randomString(size)
 	if err != nil {
 		return nil, err
 	}
 
-	token.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	token.Plaintext = plaintext
 	hash := sha256.Sum256([]byte(token.Plaintext))
 	token.Hash = hash[:]
 
+	session, err := NewSession("", "")
+	if err != nil {
+		return nil, err
+	}
+
+	token.SessionID = session.ID
+	token.CreatedAt = session.CreatedAt
+	token.LastUsedAt = session.CreatedAt
+
 	return token, nil
 }
 
-func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
+// codePlaintext is what the hash of a numeric code token is taken of. A short
+// code is far from unique on its own, so it is qualified with the user id.
+func codePlaintext(userID int64, code string) string {
+	return fmt.Sprintf("%d:%s", userID, code)
+}
+
+func randomCode(digits int) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(math.Pow10(digits))))
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string, length int) {
 	v.Check(tokenPlaintext != "", "token", "must be provided")
-	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
+	v.Check(len(tokenPlaintext) == length, "token", fmt.Sprintf("must be %d bytes long", length))
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB     *sql.DB
+	Scopes map[string]TokenScope
+	Cache  *TokenCache
+}
+
+func (m TokenModel) Scope(name string) (TokenScope, error) {
+	scope, ok := m.Scopes[name]
+	if !ok {
+		return TokenScope{}, ErrUnknownTokenScope
+	}
+
+	return scope, nil
 }
 
 func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
-	token, err := generateToken(userID, ttl, scope)
+	tokenScope, err := m.Scope(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(userID, ttl, scope, tokenScope.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewCode issues a token whose plaintext is a random numeric code of the
+// given number of digits, short enough for people to type. Codes can only be
+// redeemed together with the user id, see ConsumeCode.
+func (m TokenModel) NewCode(userID int64, ttl time.Duration, scope string, digits int) (*Token, error) {
+	tokenScope, err := m.Scope(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(userID, ttl, scope, tokenScope.Size)
+	if err != nil {
+		return nil, err
+	}
+
+	token.Plaintext, err = randomCode(digits)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256([]byte(codePlaintext(userID, token.Plaintext)))
+	token.Hash = hash[:]
+
+	err = m.Insert(token)
+	return token, err
+}
+
+// NewForSession issues a token that belongs to an existing session, so that
+// it is revoked together with the rest of the session.
+func (m TokenModel) NewForSession(userID int64, ttl time.Duration, scope string, session *Session) (*Token, error) {
+	tokenScope, err := m.Scope(scope)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := generateToken(userID, ttl, scope, tokenScope.Size)
 	if err != nil {
 		return nil, err
 	}
 
+	token.SessionID = session.ID
+	token.CreatedAt = session.CreatedAt
+	token.Client = session.Client
+	token.UserAgent = session.UserAgent
+	token.LastUsedAt = time.Now()
+	token.AuthMethods = session.AuthMethods
+	token.AuthTime = session.AuthTime
+
 	err = m.Insert(token)
 	return token, err
 }
 
 func (m TokenModel) Insert(token *Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)`
+		INSERT INTO tokens (hash, user_id, expiry, scope, session_id, created_at, client, user_agent, last_used_at, auth_methods, auth_time)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
 
 	args := []any{
 		token.Hash,
 		token.UserID,
 		token.Expiry,
 		token.Scope,
+		token.SessionID,
+		token.CreatedAt,
+		token.Client,
+		token.UserAgent,
+		token.LastUsedAt,
+		pq.Array(token.AuthMethods),
+		sql.NullTime{Time: token.AuthTime, Valid: !token.AuthTime.IsZero()},
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -91,21 +284,79 @@ func (m TokenModel) Insert(token *Token) error {
 func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
-		WHERE scope = $1 AND user_id = $2`
+		WHERE scope = $1 AND user_id = $2
+		RETURNING hash`
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	_, err := m.DB.ExecContext(ctx, query, scope, userID)
+	_, err := execEvicting(ctx, m.DB, m.Cache, query, scope, userID)
 	return err
 }
 
-func (t TokenModel) GetForToken(tokenScope, tokenPlaintext string) (*Token, error) {
+// DeleteAllForUserExcept revokes every token of the user, in any scope, that
+// does not belong to the given session.
+func (m TokenModel) DeleteAllForUserExcept(userID int64, sessionID string) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND session_id <> $2
+		RETURNING hash`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := execEvicting(ctx, m.DB, m.Cache, query, userID, sessionID)
+	return err
+}
+
+// DeleteExpired removes expired tokens in batches of batchSize until none are
+// left or ctx is done, and returns the number of deleted rows. Only one
+// process deletes at a time; the others get ErrLockHeld.
+func (m TokenModel) DeleteExpired(ctx context.Context, batchSize int) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE hash IN (
+			SELECT hash
+			FROM tokens
+			WHERE expiry < $1
+			LIMIT $2
+		)`
+
+	var deleted int64
+
+	err := withAdvisoryLock(ctx, m.DB, lockTokenReaper, func(conn *sql.Conn) error {
+		for {
+			batchCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			result, err := conn.ExecContext(batchCtx, query, time.Now(), batchSize)
+			cancel()
+			if err != nil {
+				return err
+			}
 
+			rowsAffected, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+
+			deleted += rowsAffected
+
+			if rowsAffected < int64(batchSize) || ctx.Err() != nil {
+				return nil
+			}
+		}
+	})
+
+	return deleted, err
+}
+
+// Consume marks a single-use token as used and returns it. A token that was
+// already used is reported with ErrTokenReused so the caller can treat it as
+// a replay.
+func (m TokenModel) Consume(tokenScope, tokenPlaintext string) (*Token, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT hash, user_id, expiry, scope 
+		SELECT hash, user_id, expiry, scope, session_id, created_at, client, user_agent, last_used_at, auth_methods, auth_time, used
 		FROM tokens
 		WHERE hash = $1
 		AND tokens.scope = $2
@@ -113,8 +364,150 @@ func (t TokenModel) GetForToken(tokenScope, tokenPlaintext string) (*Token, erro
 
 	args := []any{tokenHash[:], tokenScope, time.Now()}
 
+	var token Token
+	var authTime sql.NullTime
+	var used bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.SessionID,
+		&token.CreatedAt,
+		&token.Client,
+		&token.UserAgent,
+		&token.LastUsedAt,
+		pq.Array(&token.AuthMethods),
+		&authTime,
+		&used)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	token.AuthTime = authTime.Time
+
+	if used {
+		return &token, ErrTokenReused
+	}
+
+	query = `
+		UPDATE tokens
+		SET used = true
+		WHERE hash = $1 AND used = false`
+
+	result, err := m.DB.ExecContext(ctx, query, token.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	// a concurrent request consumed the token between the read and the update
+	if rowsAffected == 0 {
+		return &token, ErrTokenReused
+	}
+
+	m.Cache.Delete(token.Hash)
+
+	return &token, nil
+}
+
+// ConsumeCode is Consume for the numeric codes issued by NewCode.
+func (m TokenModel) ConsumeCode(tokenScope string, userID int64, code string) (*Token, error) {
+	return m.Consume(tokenScope, codePlaintext(userID, code))
+}
+
+// GetForPlaintext looks a token up in whichever scope it was issued, without
+// consuming it.
+func (m TokenModel) GetForPlaintext(tokenPlaintext string) (*Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	if token, ok := m.Cache.Get(tokenHash[:]); ok {
+		return token, nil
+	}
+
+	query := `
+		SELECT hash, user_id, expiry, scope, session_id, created_at, client, user_agent, last_used_at, auth_methods, auth_time
+		FROM tokens
+		WHERE hash = $1
+		AND tokens.expiry > $2
+		AND NOT tokens.used`
+
+	args := []any{tokenHash[:], time.Now()}
+
+	var token Token
+	var authTime sql.NullTime
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.SessionID,
+		&token.CreatedAt,
+		&token.Client,
+		&token.UserAgent,
+		&token.LastUsedAt,
+		pq.Array(&token.AuthMethods),
+		&authTime)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	token.AuthTime = authTime.Time
+	m.Cache.Set(&token)
+
+	return &token, nil
+}
+
+func (t TokenModel) GetForToken(tokenScope, tokenPlaintext string) (*Token, error) {
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	if token, ok := t.Cache.Get(tokenHash[:]); ok {
+		// the hash is unique, so a cached token of another scope means no match
+		if token.Scope != tokenScope {
+			return nil, ErrRecordNotFound
+		}
+
+		return token, nil
+	}
+
+	query := `
+		SELECT hash, user_id, expiry, scope, session_id, created_at, client, user_agent, last_used_at, auth_methods, auth_time
+		FROM tokens
+		WHERE hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+		AND NOT tokens.used`
+
+	args := []any{tokenHash[:], tokenScope, time.Now()}
+
 	//var user User
 	var token Token
+	var authTime sql.NullTime
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -123,7 +516,14 @@ func (t TokenModel) GetForToken(tokenScope, tokenPlaintext string) (*Token, erro
 		&token.Hash,
 		&token.UserID,
 		&token.Expiry,
-		&token.Scope)
+		&token.Scope,
+		&token.SessionID,
+		&token.CreatedAt,
+		&token.Client,
+		&token.UserAgent,
+		&token.LastUsedAt,
+		pq.Array(&token.AuthMethods),
+		&authTime)
 
 	if err != nil {
 		switch {
@@ -134,5 +534,8 @@ func (t TokenModel) GetForToken(tokenScope, tokenPlaintext string) (*Token, erro
 		}
 	}
 
+	token.AuthTime = authTime.Time
+	t.Cache.Set(&token)
+
 	return &token, nil
 }
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/validator"
+)
+
+// LoadTokenScopes starts from the default token scope settings and applies the
+// JSON config file, when given, and then the -token-scope flags on top. The
+// config file maps scope names to settings, e.g.
+//
+//	{"password-reset": {"ttl": "45m", "size": 16, "single-use": true}}
+//
+// and each flag has the form name:ttl=45m,size=16,single-use=true.
+func LoadTokenScopes(configFile string, overrides []string) (map[string]TokenScope, error) {
+	scopes := maps.Clone(DefaultTokenScopes)
+
+	if configFile != "" {
+		content, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var fileScopes map[string]map[string]any
+
+		err = json.Unmarshal(content, &fileScopes)
+		if err != nil {
+			return nil, fmt.Errorf("token config file: %w", err)
+		}
+
+		for name, settings := range fileScopes {
+			for key, value := range settings {
+				err = applyTokenScopeSetting(scopes, name, key, fmt.Sprint(value))
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, override := range overrides {
+		name, settings, found := strings.Cut(override, ":")
+		if !found {
+			return nil, fmt.Errorf("token scope %q: expected name:key=value,...", override)
+		}
+
+		for _, setting := range strings.Split(settings, ",") {
+			key, value, _ := strings.Cut(setting, "=")
+
+			err := applyTokenScopeSetting(scopes, name, key, value)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, scope := range scopes {
+		v := validator.New()
+
+		// access tokens are looked up again and again, e.g. by Authenticate
+		v.Check(!(scope.SingleUse && (name == ScopeAuthentication || name == ScopeAPIKey)), "single-use", "must be false for access tokens")
+
+		if ValidateTokenScope(v, scope); !v.Valid() {
+			for key, message := range v.Errors {
+				return nil, fmt.Errorf("token scope %q: %s %s", name, key, message)
+			}
+		}
+	}
+
+	return scopes, nil
+}
+
+func applyTokenScopeSetting(scopes map[string]TokenScope, name, key, value string) error {
+	scope, ok := scopes[name]
+	if !ok {
+		scope = TokenScope{Size: 16}
+	}
+
+	var err error
+
+	switch key {
+	case "ttl":
+		scope.TTL, err = time.ParseDuration(value)
+	case "size":
+		scope.Size, err = strconv.Atoi(value)
+	case "single-use":
+		scope.SingleUse, err = strconv.ParseBool(value)
+	default:
+		return fmt.Errorf("token scope %q: unknown setting %q", name, key)
+	}
+
+	if err != nil {
+		return fmt.Errorf("token scope %q: invalid %s: %w", name, key, err)
+	}
+
+	scopes[name] = scope
+	return nil
+}
@@ -0,0 +1,187 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrTotpEnabled    = errors.New("totp already enabled")
+	ErrTotpStepUsed   = errors.New("totp step already used")
+	ErrMissingTotpKey = errors.New("totp encryption key not configured")
+)
+
+// TotpSecret is a user's TOTP enrollment. It is pending until the user proves
+// the authenticator app works by confirming it with a code.
+type TotpSecret struct {
+	UserID       int64
+	Secret       string
+	Confirmed    bool
+	LastUsedStep int64
+	CreatedAt    time.Time
+}
+
+// TotpModel stores TOTP secrets encrypted with AES-256-GCM under Key, so that
+// a database dump alone does not reveal them.
+type TotpModel struct {
+	DB  *sql.DB
+	Key []byte
+}
+
+func (m TotpModel) encrypt(userID int64, plaintext string) ([]byte, error) {
+	if len(m.Key) == 0 {
+		return nil, ErrMissingTotpKey
+	}
+
+	return seal(m.Key, []byte(plaintext), additionalData("totp", strconv.FormatInt(userID, 10)))
+}
+
+func (m TotpModel) decrypt(userID int64, ciphertext []byte) (string, error) {
+	if len(m.Key) == 0 {
+		return "", ErrMissingTotpKey
+	}
+
+	plaintext, err := open(m.Key, ciphertext, additionalData("totp", strconv.FormatInt(userID, 10)))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// InsertPending stores a new pending secret for the user, replacing an
+// earlier pending one. It returns ErrTotpEnabled if the user already has a
+// confirmed secret.
+func (m TotpModel) InsertPending(ctx context.Context, userID int64, secret string) error {
+	ciphertext, err := m.encrypt(userID, secret)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO totp_secrets (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, last_used_step = 0, created_at = NOW()
+		WHERE NOT totp_secrets.confirmed`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, ciphertext)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTotpEnabled
+	}
+
+	return nil
+}
+
+// GetForUser returns the user's secret, pending or confirmed, or
+// ErrRecordNotFound if the user has none.
+func (m TotpModel) GetForUser(ctx context.Context, userID int64) (*TotpSecret, error) {
+	query := `
+		SELECT user_id, secret, confirmed, last_used_step, created_at
+		FROM totp_secrets
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var totpSecret TotpSecret
+	var ciphertext []byte
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&totpSecret.UserID,
+		&ciphertext,
+		&totpSecret.Confirmed,
+		&totpSecret.LastUsedStep,
+		&totpSecret.CreatedAt)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	totpSecret.Secret, err = m.decrypt(userID, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	return &totpSecret, nil
+}
+
+// Enabled reports whether the user has a confirmed secret.
+func (m TotpModel) Enabled(ctx context.Context, userID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM totp_secrets
+			WHERE user_id = $1 AND confirmed
+		)`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var enabled bool
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// UseStep records the time step of an accepted code, confirming a pending
+// secret on the way. Steps at or before the last used one are rejected with
+// ErrTotpStepUsed, so that a code cannot be replayed, even concurrently.
+func (m TotpModel) UseStep(ctx context.Context, userID int64, step int64) error {
+	query := `
+		UPDATE totp_secrets
+		SET last_used_step = $2, confirmed = true
+		WHERE user_id = $1 AND last_used_step < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTotpStepUsed
+	}
+
+	return nil
+}
+
+// DeleteForUser removes the user's secret, disabling TOTP.
+func (m TotpModel) DeleteForUser(ctx context.Context, userID int64) error {
+	query := `
+		DELETE FROM totp_secrets
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
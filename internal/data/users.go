@@ -7,8 +7,9 @@ import (
 	"errors"
 	"time"
 
+	"github.com/lib/pq"
+	"github.com/saarwasserman/auth/internal/hasher"
 	"github.com/saarwasserman/auth/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -36,30 +37,25 @@ type password struct {
 	hash      []byte
 }
 
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+func (p *password) Set(plaintextPassword string, h *hasher.Hasher) error {
+	hash, err := h.Hash(plaintextPassword)
 	if err != nil {
 		return err
 	}
 
 	p.plaintext = &plaintextPassword
-	p.hash = hash
+	p.hash = []byte(hash)
 
 	return nil
 }
 
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+func (p *password) Matches(plaintextPassword string, h *hasher.Hasher) (bool, error) {
+	match, _, err := h.Verify(plaintextPassword, string(p.hash))
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+		return false, err
 	}
 
-	return true, nil
+	return match, nil
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -70,7 +66,7 @@ func ValidateEmail(v *validator.Validator, email string) {
 func ValidatePlaintextPassword(v *validator.Validator, password string) {
 	v.Check(password != "", "password", "must be provided")
 	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 72 bytes long")
+	v.Check(len(password) <= 1024, "password", "must not be more than 1024 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -89,7 +85,8 @@ func ValidateUser(v *validator.Validator, user *User) {
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB    *sql.DB
+	Cache *TokenCache
 }
 
 func (m UserModel) Insert(user *User) error {
@@ -221,22 +218,42 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (int64, error)
 
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
+	if token, ok := m.Cache.Get(tokenHash[:]); ok {
+		if token.Scope != tokenScope {
+			return -1, ErrRecordNotFound
+		}
+
+		return token.UserID, nil
+	}
+
 	query := `
-		SELECT user_id
+		SELECT hash, user_id, expiry, scope, session_id, created_at, client, user_agent, last_used_at, auth_methods, auth_time
 		FROM tokens
 		WHERE hash = $1
 		AND tokens.scope = $2
-		AND tokens.expiry > $3`
+		AND tokens.expiry > $3
+		AND NOT tokens.used`
 
 	args := []any{tokenHash[:], tokenScope, time.Now()}
 
-	//var user User
-	var userId int64
+	var token Token
+	var authTime sql.NullTime
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&userId)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&token.Hash,
+		&token.UserID,
+		&token.Expiry,
+		&token.Scope,
+		&token.SessionID,
+		&token.CreatedAt,
+		&token.Client,
+		&token.UserAgent,
+		&token.LastUsedAt,
+		pq.Array(&token.AuthMethods),
+		&authTime)
 
 	if err != nil {
 		switch {
@@ -247,5 +264,8 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (int64, error)
 		}
 	}
 
-	return userId, nil
+	token.AuthTime = authTime.Time
+	m.Cache.Set(&token)
+
+	return token.UserID, nil
 }
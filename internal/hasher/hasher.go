@@ -0,0 +1,269 @@
+package hasher
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	AlgorithmArgon2id = "argon2id"
+	AlgorithmBcrypt   = "bcrypt"
+	AlgorithmScrypt   = "scrypt"
+)
+
+var (
+	ErrUnknownAlgorithm = errors.New("unknown password hash algorithm")
+	ErrInvalidHash      = errors.New("invalid password hash")
+	ErrPasswordTooLong  = errors.New("password too long for the hash algorithm")
+	ErrInvalidParams    = errors.New("invalid password hash parameters")
+)
+
+var encoding = base64.RawStdEncoding
+
+type Argon2idParams struct {
+	Memory      uint32 // KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type BcryptParams struct {
+	Cost int
+}
+
+type ScryptParams struct {
+	LogN       uint8
+	R          int
+	P          int
+	SaltLength uint32
+	KeyLength  uint32
+}
+
+// Hasher hashes passwords into PHC strings with the configured algorithm and
+// parameters, and verifies hashes made by any supported algorithm. Bcrypt
+// hashes keep their native $2a$ format.
+type Hasher struct {
+	Algorithm string
+	Argon2id  Argon2idParams
+	Bcrypt    BcryptParams
+	Scrypt    ScryptParams
+
+	placeholderOnce sync.Once
+	placeholder     string
+	placeholderErr  error
+}
+
+func New() *Hasher {
+	return &Hasher{
+		Algorithm: AlgorithmArgon2id,
+		Argon2id: Argon2idParams{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 2,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+		Bcrypt: BcryptParams{
+			Cost: 12,
+		},
+		Scrypt: ScryptParams{
+			LogN:       15,
+			R:          8,
+			P:          1,
+			SaltLength: 16,
+			KeyLength:  32,
+		},
+	}
+}
+
+// Validate checks that the parameters of every algorithm are within the
+// range the algorithm accepts, so that a misconfiguration fails at startup
+// rather than at the first login.
+func (h *Hasher) Validate() error {
+	switch {
+	case h.Argon2id.Iterations < 1 || h.Argon2id.Parallelism < 1 || h.Argon2id.Memory < 8*uint32(h.Argon2id.Parallelism):
+		return fmt.Errorf("%w: argon2id needs at least 1 iteration, a parallelism of 1 and 8 KiB of memory per thread", ErrInvalidParams)
+	case h.Bcrypt.Cost < bcrypt.MinCost || h.Bcrypt.Cost > bcrypt.MaxCost:
+		return fmt.Errorf("%w: bcrypt cost must be between %d and %d", ErrInvalidParams, bcrypt.MinCost, bcrypt.MaxCost)
+	case h.Scrypt.LogN < 1 || h.Scrypt.LogN > 30 || h.Scrypt.R < 1 || h.Scrypt.P < 1 || uint64(h.Scrypt.R)*uint64(h.Scrypt.P) >= 1<<30:
+		return fmt.Errorf("%w: scrypt ln must be between 1 and 30, and r and p positive with r*p below 2^30", ErrInvalidParams)
+	}
+
+	return nil
+}
+
+func (h *Hasher) Hash(plaintext string) (string, error) {
+	switch h.Algorithm {
+	case AlgorithmArgon2id:
+		salt, err := randomSalt(h.Argon2id.SaltLength)
+		if err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(plaintext), salt, h.Argon2id.Iterations, h.Argon2id.Memory, h.Argon2id.Parallelism, h.Argon2id.KeyLength)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, h.Argon2id.Memory, h.Argon2id.Iterations, h.Argon2id.Parallelism,
+			encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+	case AlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), h.Bcrypt.Cost)
+		if err != nil {
+			if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+				return "", ErrPasswordTooLong
+			}
+			return "", err
+		}
+
+		return string(hash), nil
+	case AlgorithmScrypt:
+		salt, err := randomSalt(h.Scrypt.SaltLength)
+		if err != nil {
+			return "", err
+		}
+
+		key, err := scrypt.Key([]byte(plaintext), salt, 1<<h.Scrypt.LogN, h.Scrypt.R, h.Scrypt.P, int(h.Scrypt.KeyLength))
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+			h.Scrypt.LogN, h.Scrypt.R, h.Scrypt.P,
+			encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+	default:
+		return "", ErrUnknownAlgorithm
+	}
+}
+
+// Verify reports whether the plaintext matches the encoded hash, and whether
+// the hash should be replaced because it was made with another algorithm or
+// other parameters than the hasher is configured with.
+func (h *Hasher) Verify(plaintext, encoded string) (match bool, needsRehash bool, err error) {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		var version int
+		var params Argon2idParams
+		var salt, key []byte
+
+		parts := strings.Split(encoded, "$")
+		if len(parts) != 6 {
+			return false, false, ErrInvalidHash
+		}
+
+		_, err = fmt.Sscanf(parts[2], "v=%d", &version)
+		if err != nil || version != argon2.Version {
+			return false, false, ErrInvalidHash
+		}
+
+		_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+		if err != nil {
+			return false, false, ErrInvalidHash
+		}
+
+		salt, key, err = decodeSaltAndKey(parts[4], parts[5])
+		if err != nil {
+			return false, false, err
+		}
+
+		params.SaltLength = uint32(len(salt))
+		params.KeyLength = uint32(len(key))
+
+		candidate := argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		match = subtle.ConstantTimeCompare(key, candidate) == 1
+
+		return match, h.Algorithm != AlgorithmArgon2id || params != h.Argon2id, nil
+	case strings.HasPrefix(encoded, "$scrypt$"):
+		var params ScryptParams
+		var salt, key []byte
+
+		parts := strings.Split(encoded, "$")
+		if len(parts) != 5 {
+			return false, false, ErrInvalidHash
+		}
+
+		_, err = fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &params.LogN, &params.R, &params.P)
+		if err != nil || params.LogN > 30 {
+			return false, false, ErrInvalidHash
+		}
+
+		salt, key, err = decodeSaltAndKey(parts[3], parts[4])
+		if err != nil {
+			return false, false, err
+		}
+
+		params.SaltLength = uint32(len(salt))
+		params.KeyLength = uint32(len(key))
+
+		candidate, err := scrypt.Key([]byte(plaintext), salt, 1<<params.LogN, params.R, params.P, len(key))
+		if err != nil {
+			return false, false, err
+		}
+
+		match = subtle.ConstantTimeCompare(key, candidate) == 1
+
+		return match, h.Algorithm != AlgorithmScrypt || params != h.Scrypt, nil
+	case strings.HasPrefix(encoded, "$2"):
+		err = bcrypt.CompareHashAndPassword([]byte(encoded), []byte(plaintext))
+		if err != nil {
+			switch {
+			case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+				return false, false, nil
+			default:
+				return false, false, err
+			}
+		}
+
+		cost, err := bcrypt.Cost([]byte(encoded))
+		if err != nil {
+			return false, false, err
+		}
+
+		return true, h.Algorithm != AlgorithmBcrypt || cost != h.Bcrypt.Cost, nil
+	default:
+		return false, false, ErrInvalidHash
+	}
+}
+
+// Placeholder returns a hash made with the configured algorithm, to verify
+// against when there is no real hash so that the check costs the same.
+func (h *Hasher) Placeholder() (string, error) {
+	h.placeholderOnce.Do(func() {
+		h.placeholder, h.placeholderErr = h.Hash("placeholder password")
+	})
+
+	return h.placeholder, h.placeholderErr
+}
+
+func randomSalt(length uint32) ([]byte, error) {
+	salt := make([]byte, length)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return salt, nil
+}
+
+func decodeSaltAndKey(encodedSalt, encodedKey string) ([]byte, []byte, error) {
+	salt, err := encoding.DecodeString(encodedSalt)
+	if err != nil {
+		return nil, nil, ErrInvalidHash
+	}
+
+	key, err := encoding.DecodeString(encodedKey)
+	if err != nil || len(key) == 0 {
+		return nil, nil, ErrInvalidHash
+	}
+
+	return salt, key, nil
+}
@@ -0,0 +1,87 @@
+package hasher
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrUnknownPepperVersion = errors.New("unknown pepper version")
+)
+
+// Peppers holds the versioned server-side secrets mixed into passwords
+// before they are hashed. Version 0 means no pepper, which is how rows
+// written before peppering was configured are verified. New hashes use the
+// highest version.
+type Peppers struct {
+	Current int
+	keys    map[int][]byte
+}
+
+// ParsePeppers reads peppers in the form version:base64secret, separated by
+// commas or newlines, e.g. "1:c2VjcmV0...,2:bW9yZS...". Every secret must be
+// at least 32 bytes long. An empty string yields no peppers.
+func ParsePeppers(s string) (*Peppers, error) {
+	peppers := &Peppers{keys: map[int][]byte{}}
+
+	fields := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == '\n'
+	})
+
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		encodedVersion, encodedKey, found := strings.Cut(field, ":")
+		if !found {
+			return nil, errors.New("pepper: expected version:base64secret")
+		}
+
+		version, err := strconv.Atoi(encodedVersion)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("pepper: invalid version %q", encodedVersion)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("pepper %d: %w", version, err)
+		}
+
+		if len(key) < 32 {
+			return nil, fmt.Errorf("pepper %d: must be at least 32 bytes long", version)
+		}
+
+		if _, exists := peppers.keys[version]; exists {
+			return nil, fmt.Errorf("pepper %d: duplicate version", version)
+		}
+
+		peppers.keys[version] = key
+		peppers.Current = max(peppers.Current, version)
+	}
+
+	return peppers, nil
+}
+
+// Apply mixes the pepper of the given version into the plaintext password.
+func (p *Peppers) Apply(version int, plaintext string) (string, error) {
+	if version == 0 {
+		return plaintext, nil
+	}
+
+	key, ok := p.keys[version]
+	if !ok {
+		return "", ErrUnknownPepperVersion
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(plaintext))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,4 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS family_id text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS used boolean NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS tokens_family_id_idx ON tokens (family_id);
@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS tokens_user_id_idx;
+
+ALTER TABLE tokens DROP COLUMN IF EXISTS user_agent;
+ALTER TABLE tokens DROP COLUMN IF EXISTS client;
+ALTER TABLE tokens DROP COLUMN IF EXISTS created_at;
+
+ALTER INDEX IF EXISTS tokens_session_id_idx RENAME TO tokens_family_id_idx;
+ALTER TABLE tokens RENAME COLUMN session_id TO family_id;
@@ -0,0 +1,8 @@
+ALTER TABLE tokens RENAME COLUMN family_id TO session_id;
+ALTER INDEX IF EXISTS tokens_family_id_idx RENAME TO tokens_session_id_idx;
+
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS created_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS client text NOT NULL DEFAULT '';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS user_agent text NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS tokens_user_id_idx ON tokens (user_id);
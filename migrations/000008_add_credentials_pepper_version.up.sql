@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN IF NOT EXISTS pepper_version integer NOT NULL DEFAULT 0;
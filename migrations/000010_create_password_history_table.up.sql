@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS password_history (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    password_hash bytea NOT NULL,
+    pepper_version integer NOT NULL DEFAULT 0,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS password_history_user_id_idx ON password_history (user_id, id DESC);
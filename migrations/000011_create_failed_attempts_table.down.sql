@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'accounts:unlock';
+DROP TABLE IF EXISTS failed_attempts;
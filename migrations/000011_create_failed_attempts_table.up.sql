@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS failed_attempts (
+    key text PRIMARY KEY,
+    count integer NOT NULL,
+    last_failed_at timestamp(0) with time zone NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS failed_attempts_last_failed_at_idx ON failed_attempts (last_failed_at);
+
+INSERT INTO permissions (code)
+VALUES
+    ('accounts:unlock');
@@ -0,0 +1 @@
+ALTER TABLE credentials ADD COLUMN IF NOT EXISTS password_changed_at timestamp(0) with time zone NOT NULL DEFAULT NOW();
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS passkeys (
+    id bytea PRIMARY KEY,
+    user_id bigint NOT NULL,
+    public_key bytea NOT NULL,
+    attestation_type text NOT NULL,
+    transports text[] NOT NULL DEFAULT '{}',
+    aaguid bytea NOT NULL,
+    sign_count bigint NOT NULL DEFAULT 0,
+    backup_eligible boolean NOT NULL DEFAULT false,
+    backup_state boolean NOT NULL DEFAULT false,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    last_used_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS passkeys_user_id_idx ON passkeys (user_id);
@@ -0,0 +1,2 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS auth_time;
+ALTER TABLE tokens DROP COLUMN IF EXISTS auth_methods;
@@ -0,0 +1,2 @@
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS auth_methods text[] NOT NULL DEFAULT '{}';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS auth_time timestamp(0) with time zone;
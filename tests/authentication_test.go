@@ -2,19 +2,40 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"math/rand/v2"
 	"testing"
+	"time"
 
 	"github.com/saarwasserman/auth/internal/data"
 	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+// testClientAddress returns a dial option that sends a random client address
+// in X-Forwarded-For, so that the per-IP lockout counters of one test don't
+// lock out the next. The service only honours it with the loopback address in
+// -lockout-trusted-proxies.
+func testClientAddress() grpc.DialOption {
+	addr := fmt.Sprintf("198.18.%d.%d", rand.IntN(256), rand.IntN(256))
+
+	return grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", addr)
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+}
+
 func TestAuthenticate(t *testing.T) {
 
 	var opts []grpc.DialOption
 	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
 
 	conn, err := grpc.NewClient("localhost:40020", opts...)
 	if err != nil {
@@ -40,3 +61,109 @@ func TestAuthenticate(t *testing.T) {
 		log.Print("found a user with that token")
 	}
 }
+
+func TestLoginInvalidCredentials(t *testing.T) {
+
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	_, err = authClient.Login(context.Background(), &auth.LoginRequest{
+		Email:    "no-such-user@example.com",
+		Password: "not-the-password",
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected %s, got %v", codes.Unauthenticated, err)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	email := fmt.Sprintf("lockout-%d@example.com", time.Now().UnixNano())
+
+	// with the default -lockout-backoff-after the fourth attempt backs off
+	for attempt := 1; attempt <= 4; attempt++ {
+		_, err = authClient.Login(context.Background(), &auth.LoginRequest{
+			Email:    email,
+			Password: "not-the-password",
+		})
+		if status.Code(err) == codes.ResourceExhausted {
+			break
+		}
+	}
+
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected %s, got %v", codes.ResourceExhausted, err)
+	}
+
+	found := false
+	for _, detail := range status.Convert(err).Details() {
+		if _, ok := detail.(*errdetails.RetryInfo); ok {
+			found = true
+		}
+	}
+
+	if !found {
+		t.Error("expected the error to carry a retry delay")
+	}
+}
+
+func TestInvalidTokenIPLockout(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	token := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11})
+
+	// with the default -lockout-ip-backoff-after the 21st invalid token backs off
+	invalidCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer NOT-A-VALID-TOKEN")
+	for attempt := 1; attempt <= 21; attempt++ {
+		_, err = authClient.ListSessions(invalidCtx, &auth.ListSessionsRequest{})
+		if status.Code(err) == codes.ResourceExhausted {
+			break
+		}
+	}
+
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected %s, got %v", codes.ResourceExhausted, err)
+	}
+
+	// callers behind the same address keep working with valid tokens
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+token.TokenPlaintext)
+
+	_, err = authClient.ListSessions(ctx, &auth.ListSessionsRequest{})
+	if err != nil {
+		t.Errorf("expected a valid token to pass the IP lock, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/saarwasserman/auth/internal/breach"
+)
+
+func TestBreachIndex(t *testing.T) {
+	breached := []string{"password", "123456", "qwerty", "letmein", "pa55word"}
+
+	var lines []string
+	for i, password := range breached {
+		lines = append(lines, fmt.Sprintf("%X:%d", sha1.Sum([]byte(password)), i+1))
+	}
+	slices.Sort(lines)
+
+	dir := t.TempDir()
+
+	dst, err := os.Create(filepath.Join(dir, "breach.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, err := breach.Build(dst, strings.NewReader(strings.Join(lines, "\r\n")), 1)
+	dst.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != uint64(len(breached)) {
+		t.Errorf("expected %d hashes, got %d", len(breached), count)
+	}
+
+	index, err := breach.Open(dst.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	for _, password := range breached {
+		found, err := index.Contains(password)
+		if err != nil || !found {
+			t.Errorf("expected %q to be found, got %v err=%v", password, found, err)
+		}
+	}
+
+	found, err := index.Contains("Kq7#vLm2!xRt")
+	if err != nil || found {
+		t.Errorf("expected an unbreached password not to be found, got %v err=%v", found, err)
+	}
+
+	slices.Reverse(lines)
+
+	unsorted, err := os.Create(filepath.Join(dir, "unsorted.idx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unsorted.Close()
+
+	_, err = breach.Build(unsorted, strings.NewReader(strings.Join(lines, "\n")), 1)
+	if !errors.Is(err, breach.ErrUnsorted) {
+		t.Errorf("expected %v, got %v", breach.ErrUnsorted, err)
+	}
+}
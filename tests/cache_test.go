@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/saarwasserman/auth/internal/data"
+)
+
+func TestTokenCache(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	cache := data.NewTokenCache(client, time.Minute)
+
+	hash := sha256.Sum256([]byte("VISIAMIDA5YZ4Y26N5TPLFLR44"))
+	token := &data.Token{
+		Hash:        hash[:],
+		UserID:      11,
+		Expiry:      time.Now().Add(10 * time.Second),
+		Scope:       data.ScopeAuthentication,
+		SessionID:   "session",
+		AuthMethods: []string{data.AuthMethodPasskey},
+		AuthTime:    time.Now().Truncate(time.Second),
+	}
+
+	cache.Set(token)
+
+	cached, ok := cache.Get(hash[:])
+	if !ok {
+		t.Fatal("expected a cache hit")
+	}
+
+	if cached.UserID != token.UserID || cached.SessionID != token.SessionID {
+		t.Errorf("unexpected cached token %+v", cached)
+	}
+
+	if len(cached.AuthMethods) != 1 || !cached.AuthTime.Equal(token.AuthTime) {
+		t.Errorf("expected the authentication to be cached, got %v at %v", cached.AuthMethods, cached.AuthTime)
+	}
+
+	// the entry must not outlive the token
+	for _, key := range server.Keys() {
+		if ttl := server.TTL(key); ttl > 10*time.Second {
+			t.Errorf("expected ttl capped at the token expiry, got %s", ttl)
+		}
+	}
+
+	cache.Delete(hash[:])
+
+	if _, ok := cache.Get(hash[:]); ok {
+		t.Error("expected a cache miss after eviction")
+	}
+
+	// a lookup that read the token before it was evicted cannot cache it again
+	cache.Set(token)
+
+	if _, ok := cache.Get(hash[:]); ok {
+		t.Error("expected an evicted token to stay out of the cache")
+	}
+
+	server.FastForward(time.Minute)
+
+	token.Expiry = time.Now().Add(10 * time.Second)
+	cache.Set(token)
+
+	if _, ok := cache.Get(hash[:]); !ok {
+		t.Error("expected the token to be cached again once the tombstone expired")
+	}
+
+	// redis being down is a miss, not a failure
+	cache.Set(token)
+	server.Close()
+
+	if _, ok := cache.Get(hash[:]); ok {
+		t.Error("expected a cache miss while redis is down")
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/hasher"
+)
+
+// openTestDB connects to the local Postgres in AUTH_DB_DSN, with all
+// migrations applied.
+func openTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("AUTH_DB_DSN")
+	if dsn == "" {
+		t.Skip("AUTH_DB_DSN is not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+// newTestPasswordModel connects to the local Postgres in AUTH_DB_DSN, with
+// all migrations applied, and returns a model with a fast hasher and a user
+// id that has no credentials yet. The user's rows are removed afterwards.
+func newTestPasswordModel(t *testing.T) (data.PasswordModel, int64) {
+	t.Helper()
+
+	db := openTestDB(t)
+
+	h := hasher.New()
+	h.Argon2id.Memory = 1024
+	h.Argon2id.Iterations = 1
+
+	peppers, err := hasher.ParsePeppers("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ids far above any real user's
+	userID := 1<<40 + rand.Int64N(1<<40)
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM credentials WHERE user_id = $1", userID)
+		db.Exec("DELETE FROM password_history WHERE user_id = $1", userID)
+		db.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userID)
+		db.Exec("DELETE FROM passkeys WHERE user_id = $1", userID)
+	})
+
+	return data.PasswordModel{DB: db, Hasher: h, Peppers: peppers, HistorySize: 2}, userID
+}
+
+func TestPasswordModelSet(t *testing.T) {
+	m, userID := newTestPasswordModel(t)
+	ctx := context.Background()
+
+	_, _, err := m.GetPasswordForUserId(ctx, userID)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Fatalf("expected %v, got %v", data.ErrRecordNotFound, err)
+	}
+
+	// setting twice replaces the credentials instead of failing on the key
+	for _, password := range []string{"first-pa55word", "second-pa55word"} {
+		hash, pepperVersion, err := m.Hash(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.SetPasswordForUserId(ctx, userID, hash, pepperVersion)
+		if err != nil {
+			t.Fatalf("couldn't set password: %s", err.Error())
+		}
+	}
+
+	match, _, err := m.Matches(ctx, userID, "second-pa55word")
+	if err != nil || !match {
+		t.Errorf("expected the latest password to match, got %v err=%v", match, err)
+	}
+
+	match, _, err = m.Matches(ctx, userID, "first-pa55word")
+	if err != nil || match {
+		t.Errorf("expected the replaced password not to match, got %v err=%v", match, err)
+	}
+
+	reused, err := m.MatchesHistory(ctx, userID, "first-pa55word")
+	if err != nil || !reused {
+		t.Errorf("expected the replaced password to be in the history, got %v err=%v", reused, err)
+	}
+
+	changedAt, err := m.ChangedAt(ctx, userID)
+	if err != nil || time.Since(changedAt) > time.Minute {
+		t.Errorf("expected a recent change time, got %v err=%v", changedAt, err)
+	}
+}
+
+func TestPasswordModelHistory(t *testing.T) {
+	m, userID := newTestPasswordModel(t)
+	ctx := context.Background()
+
+	setPassword := func(password string) {
+		t.Helper()
+
+		hash, pepperVersion, err := m.Hash(password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = m.SetPasswordForUserId(ctx, userID, hash, pepperVersion)
+		if err != nil {
+			t.Fatalf("couldn't set password: %s", err.Error())
+		}
+	}
+
+	historySize := func() int {
+		t.Helper()
+
+		var count int
+		err := m.DB.QueryRow("SELECT COUNT(*) FROM password_history WHERE user_id = $1", userID).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return count
+	}
+
+	for _, password := range []string{"first-pa55word", "second-pa55word", "third-pa55word"} {
+		setPassword(password)
+	}
+
+	// the current password and HistorySize previous ones are remembered
+	for _, password := range []string{"first-pa55word", "second-pa55word", "third-pa55word"} {
+		reused, err := m.MatchesHistory(ctx, userID, password)
+		if err != nil || !reused {
+			t.Errorf("expected %q to be rejected, got %v err=%v", password, reused, err)
+		}
+	}
+
+	setPassword("fourth-pa55word")
+
+	// the history is pruned to the newest HistorySize entries
+	if size := historySize(); size != m.HistorySize {
+		t.Errorf("expected %d history entries, got %d", m.HistorySize, size)
+	}
+
+	reused, err := m.MatchesHistory(ctx, userID, "first-pa55word")
+	if err != nil || reused {
+		t.Errorf("expected a pruned password to be accepted again, got %v err=%v", reused, err)
+	}
+
+	// disabling the history keeps the existing entries
+	m.HistorySize = 0
+	setPassword("fifth-pa55word")
+
+	if size := historySize(); size != 2 {
+		t.Errorf("expected the history to be left alone while disabled, got %d entries", size)
+	}
+}
+
+func TestPasswordModelCurrentWithoutHistory(t *testing.T) {
+	m, userID := newTestPasswordModel(t)
+	m.HistorySize = 0
+	ctx := context.Background()
+
+	hash, pepperVersion, err := m.Hash("current-pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.SetPasswordForUserId(ctx, userID, hash, pepperVersion)
+	if err != nil {
+		t.Fatalf("couldn't set password: %s", err.Error())
+	}
+
+	// without a history a password change still may not keep the password
+	reused, err := m.MatchesHistory(ctx, userID, "current-pa55word")
+	if err != nil || !reused {
+		t.Errorf("expected the current password to be rejected, got %v err=%v", reused, err)
+	}
+
+	reused, err = m.MatchesHistory(ctx, userID, "another-pa55word")
+	if err != nil || reused {
+		t.Errorf("expected a new password to be accepted, got %v err=%v", reused, err)
+	}
+}
+
+func TestPasswordModelUpdate(t *testing.T) {
+	m, userID := newTestPasswordModel(t)
+	ctx := context.Background()
+
+	hash, pepperVersion, err := m.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.UpdatePasswordForUserId(ctx, userID, hash, pepperVersion)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Fatalf("expected updating missing credentials to return %v, got %v", data.ErrRecordNotFound, err)
+	}
+
+	err = m.SetPasswordForUserId(ctx, userID, hash, pepperVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rehash, pepperVersion, err := m.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.UpdatePasswordForUserId(ctx, userID, rehash, pepperVersion)
+	if err != nil {
+		t.Fatalf("couldn't update password: %s", err.Error())
+	}
+
+	stored, _, err := m.GetPasswordForUserId(ctx, userID)
+	if err != nil || stored != rehash {
+		t.Errorf("expected the new hash to be stored, got err=%v", err)
+	}
+}
+
+func TestPasswordModelCanceledContext(t *testing.T) {
+	m, userID := newTestPasswordModel(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, _, err := m.GetPasswordForUserId(ctx, userID)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestRecoveryCodeModel(t *testing.T) {
+	passwords, userID := newTestPasswordModel(t)
+	m := data.RecoveryCodeModel{DB: passwords.DB}
+	ctx := context.Background()
+
+	codes, err := data.NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(codes) != data.RecoveryCodeCount {
+		t.Fatalf("expected %d codes, got %d", data.RecoveryCodeCount, len(codes))
+	}
+
+	err = m.ReplaceForUser(ctx, userID, codes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// codes are accepted regardless of case and separators, but only once
+	err = m.Consume(ctx, userID, strings.ToLower(strings.ReplaceAll(codes[0], "-", "")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Consume(ctx, userID, codes[0])
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("expected a used code to give %v, got %v", data.ErrRecordNotFound, err)
+	}
+
+	err = m.Consume(ctx, userID+1, codes[1])
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("expected another user's code to give %v, got %v", data.ErrRecordNotFound, err)
+	}
+
+	regenerated, err := data.NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.ReplaceForUser(ctx, userID, regenerated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Consume(ctx, userID, codes[1])
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("expected a code of the previous set to give %v, got %v", data.ErrRecordNotFound, err)
+	}
+
+	err = m.Consume(ctx, userID, regenerated[1])
+	if err != nil {
+		t.Errorf("expected a code of the new set to be accepted, got %v", err)
+	}
+}
+
+func TestPasskeyModel(t *testing.T) {
+	passwords, userID := newTestPasswordModel(t)
+	m := data.PasskeyModel{DB: passwords.DB}
+	ctx := context.Background()
+
+	id := make([]byte, 16)
+	binary.BigEndian.PutUint64(id, uint64(userID))
+
+	passkey := &data.Passkey{
+		ID:              id,
+		UserID:          userID,
+		PublicKey:       []byte("public key"),
+		AttestationType: "none",
+		Transports:      []string{"internal", "hybrid"},
+		AAGUID:          make([]byte, 16),
+	}
+
+	err := m.Insert(ctx, passkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Insert(ctx, passkey)
+	if !errors.Is(err, data.ErrDuplicatePasskey) {
+		t.Errorf("expected %v, got %v", data.ErrDuplicatePasskey, err)
+	}
+
+	passkeys, err := m.GetAllForUser(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(passkeys) != 1 || len(passkeys[0].Transports) != 2 {
+		t.Fatalf("expected the inserted passkey, got %+v", passkeys)
+	}
+
+	// authenticators without a counter always send 0
+	err = m.Use(ctx, id, 0, false)
+	if err != nil {
+		t.Errorf("expected a zero sign count to be accepted while it was zero, got %v", err)
+	}
+
+	err = m.Use(ctx, id, 5, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, signCount := range []uint32{0, 4, 5} {
+		err = m.Use(ctx, id, signCount, true)
+		if !errors.Is(err, data.ErrSignCountReplayed) {
+			t.Errorf("sign count %d: expected %v, got %v", signCount, data.ErrSignCountReplayed, err)
+		}
+	}
+}
+
+func TestSigningKeyModel(t *testing.T) {
+	db := openTestDB(t)
+
+	// the running service's key, if any, so that its keys decrypt too
+	key, _ := base64.StdEncoding.DecodeString(os.Getenv("AUTH_JWT_KEY"))
+	if len(key) != 32 {
+		key = make([]byte, 32)
+		crand.Read(key)
+	}
+
+	m := data.SigningKeyModel{DB: db, Key: key}
+
+	signingKey, err := data.NewSigningKey(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM signing_keys WHERE id = $1", signingKey.ID) })
+
+	err = m.Insert(signingKey)
+	if err != nil {
+		t.Fatalf("couldn't insert signing key: %s", err.Error())
+	}
+
+	var stored []byte
+	err = db.QueryRow("SELECT private_key FROM signing_keys WHERE id = $1", signingKey.ID).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stored, signingKey.PrivateKey.Seed()) {
+		t.Error("expected the private key to be stored encrypted")
+	}
+
+	keys, err := m.GetAllActive()
+	if err != nil {
+		t.Fatalf("couldn't load signing keys: %s", err.Error())
+	}
+
+	found := false
+	for _, k := range keys {
+		if k.ID == signingKey.ID {
+			found = k.PrivateKey.Equal(signingKey.PrivateKey)
+		}
+	}
+
+	if !found {
+		t.Error("expected the inserted key to decrypt to the original")
+	}
+
+	_, err = data.SigningKeyModel{DB: db, Key: make([]byte, 32)}.GetAllActive()
+	if !errors.Is(err, data.ErrInvalidCiphertext) {
+		t.Errorf("expected %v under another key, got %v", data.ErrInvalidCiphertext, err)
+	}
+
+	err = data.SigningKeyModel{DB: db}.Insert(signingKey)
+	if !errors.Is(err, data.ErrMissingSigningKeyKey) {
+		t.Errorf("expected %v without a key, got %v", data.ErrMissingSigningKeyKey, err)
+	}
+}
+
+func TestFailedAttemptModelRedisOutage(t *testing.T) {
+	db := openTestDB(t)
+
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	m := data.FailedAttemptModel{DB: db, Redis: client}
+
+	key := fmt.Sprintf("test:%d", rand.Int64())
+	t.Cleanup(func() { db.Exec("DELETE FROM failed_attempts WHERE key = $1", key) })
+
+	// failures during the outage land in Postgres
+	server.Close()
+
+	for range 3 {
+		_, _, err := m.Record(key, time.Hour)
+		if err != nil {
+			t.Fatalf("couldn't record a failure without redis: %s", err.Error())
+		}
+	}
+
+	err := server.Restart()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = m.Record(key, time.Hour)
+	if err != nil {
+		t.Fatalf("couldn't record a failure: %s", err.Error())
+	}
+
+	count, last, err := m.Get(key, time.Hour)
+	if err != nil {
+		t.Fatalf("couldn't get failures: %s", err.Error())
+	}
+
+	if count != 3 || last.IsZero() {
+		t.Errorf("expected the failures from the outage to still count, got %d at %v", count, last)
+	}
+
+	err = m.Reset(key)
+	if err != nil {
+		t.Fatalf("couldn't reset failures: %s", err.Error())
+	}
+
+	count, _, err = m.Get(key, time.Hour)
+	if err != nil || count != 0 {
+		t.Errorf("expected no failures after a reset, got %d (%v)", count, err)
+	}
+}
+
+func TestFailedAttemptModelRecordAndRefund(t *testing.T) {
+	db := openTestDB(t)
+
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	for name, m := range map[string]data.FailedAttemptModel{
+		"postgres": {DB: db},
+		"redis":    {DB: db, Redis: client},
+	} {
+		key := fmt.Sprintf("test:%d", rand.Int64())
+		t.Cleanup(func() { db.Exec("DELETE FROM failed_attempts WHERE key = $1", key) })
+
+		// parallel attempts each get a count of their own
+		counts := make(chan int, 10)
+		for range cap(counts) {
+			go func() {
+				count, _, err := m.Record(key, time.Hour)
+				if err != nil {
+					t.Errorf("%s: couldn't record a failure: %s", name, err.Error())
+				}
+				counts <- count
+			}()
+		}
+
+		seen := map[int]bool{}
+		for range cap(counts) {
+			seen[<-counts] = true
+		}
+
+		if len(seen) != cap(counts) || !seen[1] || !seen[cap(counts)] {
+			t.Errorf("%s: expected counts 1 to %d, got %v", name, cap(counts), seen)
+		}
+
+		count, previous, err := m.Record(key, time.Hour)
+		if err != nil || count != 11 || previous.IsZero() {
+			t.Errorf("%s: expected the eleventh failure after an earlier one, got %d at %v (%v)", name, count, previous, err)
+		}
+
+		err = m.Refund(key)
+		if err != nil {
+			t.Fatalf("%s: couldn't refund a failure: %s", name, err.Error())
+		}
+
+		count, _, err = m.Get(key, time.Hour)
+		if err != nil || count != 10 {
+			t.Errorf("%s: expected 10 failures after a refund, got %d (%v)", name, count, err)
+		}
+
+		// a refund after a reset does not take the next failure back
+		err = m.Reset(key)
+		if err != nil {
+			t.Fatalf("%s: couldn't reset failures: %s", name, err.Error())
+		}
+
+		err = m.Refund(key)
+		if err != nil {
+			t.Fatalf("%s: couldn't refund a failure: %s", name, err.Error())
+		}
+
+		count, _, err = m.Record(key, time.Hour)
+		if err != nil || count != 1 {
+			t.Errorf("%s: expected a first failure after a reset, got %d (%v)", name, count, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/saarwasserman/auth/internal/hasher"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHasherAlgorithms(t *testing.T) {
+	h := hasher.New()
+	h.Argon2id.Memory = 1024
+	h.Argon2id.Iterations = 1
+	h.Scrypt.LogN = 10
+	h.Bcrypt.Cost = bcrypt.MinCost
+
+	for _, algorithm := range []string{hasher.AlgorithmArgon2id, hasher.AlgorithmBcrypt, hasher.AlgorithmScrypt} {
+		h.Algorithm = algorithm
+
+		hash, err := h.Hash("correct horse battery staple")
+		if err != nil {
+			t.Fatalf("%s: couldn't hash: %s", algorithm, err.Error())
+		}
+
+		match, needsRehash, err := h.Verify("correct horse battery staple", hash)
+		if err != nil || !match || needsRehash {
+			t.Errorf("%s: expected a current match, got match=%t needsRehash=%t err=%v", algorithm, match, needsRehash, err)
+		}
+
+		match, _, err = h.Verify("wrong horse battery staple", hash)
+		if err != nil || match {
+			t.Errorf("%s: expected a mismatch, got match=%t err=%v", algorithm, match, err)
+		}
+	}
+}
+
+func TestHasherUpgradesLegacyHashes(t *testing.T) {
+	// rows written before the hasher existed hold plain bcrypt hashes
+	legacy, err := bcrypt.GenerateFromPassword([]byte("pa55word"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := hasher.New()
+	h.Argon2id.Memory = 1024
+	h.Argon2id.Iterations = 1
+
+	match, needsRehash, err := h.Verify("pa55word", string(legacy))
+	if err != nil || !match || !needsRehash {
+		t.Errorf("expected legacy bcrypt hash to match and need a rehash, got match=%t needsRehash=%t err=%v", match, needsRehash, err)
+	}
+
+	hash, err := h.Hash("pa55word")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.Argon2id.Iterations = 2
+
+	_, needsRehash, err = h.Verify("pa55word", hash)
+	if err != nil || !needsRehash {
+		t.Errorf("expected a rehash after the parameters changed, got needsRehash=%t err=%v", needsRehash, err)
+	}
+}
+
+func TestHasherValidate(t *testing.T) {
+	if err := hasher.New().Validate(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(h *hasher.Hasher)
+	}{
+		{"argon2id iterations", func(h *hasher.Hasher) { h.Argon2id.Iterations = 0 }},
+		{"argon2id parallelism", func(h *hasher.Hasher) { h.Argon2id.Parallelism = 0 }},
+		{"argon2id memory", func(h *hasher.Hasher) { h.Argon2id.Memory = 8*uint32(h.Argon2id.Parallelism) - 1 }},
+		{"bcrypt cost", func(h *hasher.Hasher) { h.Bcrypt.Cost = bcrypt.MinCost - 1 }},
+		{"scrypt ln", func(h *hasher.Hasher) { h.Scrypt.LogN = 0 }},
+		{"scrypt r", func(h *hasher.Hasher) { h.Scrypt.R = 0 }},
+		{"scrypt r*p", func(h *hasher.Hasher) { h.Scrypt.R, h.Scrypt.P = 1<<15, 1<<15 }},
+	}
+
+	for _, tt := range tests {
+		h := hasher.New()
+		tt.modify(h)
+
+		if err := h.Validate(); !errors.Is(err, hasher.ErrInvalidParams) {
+			t.Errorf("%s: expected %v, got %v", tt.name, hasher.ErrInvalidParams, err)
+		}
+	}
+}
+
+func TestPeppers(t *testing.T) {
+	peppers, err := hasher.ParsePeppers(`
+		1:MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=
+		2:YWJjZGVmZ2hpamtsbW5vcHFyc3R1dnd4eXphYmNkZWY=`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if peppers.Current != 2 {
+		t.Errorf("expected the highest version to be current, got %d", peppers.Current)
+	}
+
+	unpeppered, err := peppers.Apply(0, "pa55word")
+	if err != nil || unpeppered != "pa55word" {
+		t.Errorf("expected version 0 to leave the password as is, got %q err=%v", unpeppered, err)
+	}
+
+	first, _ := peppers.Apply(1, "pa55word")
+	second, _ := peppers.Apply(2, "pa55word")
+	if first == second || first == "pa55word" {
+		t.Errorf("expected each version to pepper differently, got %q and %q", first, second)
+	}
+
+	_, err = peppers.Apply(3, "pa55word")
+	if !errors.Is(err, hasher.ErrUnknownPepperVersion) {
+		t.Errorf("expected %v, got %v", hasher.ErrUnknownPepperVersion, err)
+	}
+
+	_, err = hasher.ParsePeppers("1:c2hvcnQ=")
+	if err == nil {
+		t.Error("expected a short pepper to be rejected")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// introspectionContext authenticates as the introspection client the service
+// was started with, through INTROSPECTION_CLIENT_ID (default introspection)
+// and INTROSPECTION_CLIENT_SECRET.
+func introspectionContext(t *testing.T) context.Context {
+	t.Helper()
+
+	secret := os.Getenv("INTROSPECTION_CLIENT_SECRET")
+	if secret == "" {
+		t.Skip("INTROSPECTION_CLIENT_SECRET is not set")
+	}
+
+	clientId := os.Getenv("INTROSPECTION_CLIENT_ID")
+	if clientId == "" {
+		clientId = "introspection"
+	}
+
+	credentials := base64.StdEncoding.EncodeToString([]byte(clientId + ":" + secret))
+
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "basic "+credentials)
+}
+
+func TestIntrospectToken(t *testing.T) {
+	ctx := introspectionContext(t)
+
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	token := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11, Client: "laptop"})
+
+	_, err = authClient.IntrospectToken(context.Background(), &auth.IntrospectTokenRequest{TokenPlaintext: token.TokenPlaintext})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected introspection without client credentials to fail with %s, got %v", codes.Unauthenticated, err)
+	}
+
+	res, err := authClient.IntrospectToken(ctx, &auth.IntrospectTokenRequest{TokenPlaintext: token.TokenPlaintext})
+	if err != nil {
+		t.Fatalf("couldn't introspect token: %s", err.Error())
+	}
+
+	if !res.Active || res.Sub != "11" || res.Scope != data.ScopeAuthentication || res.ClientId != "laptop" {
+		t.Errorf("unexpected introspection %+v", res)
+	}
+
+	res, err = authClient.IntrospectToken(ctx, &auth.IntrospectTokenRequest{TokenPlaintext: "AAAAAAAAAAAAAAAAAAAAAAAAAA"})
+	if err != nil {
+		t.Fatalf("couldn't introspect token: %s", err.Error())
+	}
+
+	if res.Active || res.Sub != "" {
+		t.Errorf("expected an unknown token to be inactive, got %+v", res)
+	}
+}
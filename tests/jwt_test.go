@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/jwt"
+)
+
+func TestSignAndVerifyJWT(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys := func(keyID string) (ed25519.PublicKey, bool) {
+		return publicKey, keyID == "current"
+	}
+
+	now := time.Now()
+
+	token, err := jwt.Sign(jwt.Claims{
+		Subject:     "11",
+		Scope:       "authentication",
+		Expiry:      now.Add(time.Hour).Unix(),
+		IssuedAt:    now.Unix(),
+		ID:          "jti",
+		Permissions: []string{"movies:read"},
+		AuthMethods: []string{"password", "totp"},
+		AuthTime:    now.Unix(),
+		ACR:         "aal2",
+	}, "current", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := jwt.Verify(token, keys, now)
+	if err != nil {
+		t.Fatalf("couldn't verify token: %s", err.Error())
+	}
+
+	if claims.Subject != "11" || len(claims.Permissions) != 1 {
+		t.Errorf("unexpected claims %+v", claims)
+	}
+
+	if len(claims.AuthMethods) != 2 || claims.AuthTime != now.Unix() || claims.ACR != "aal2" {
+		t.Errorf("expected the authentication claims to round-trip, got %+v", claims)
+	}
+
+	_, err = jwt.Verify(token, keys, now.Add(2*time.Hour))
+	if !errors.Is(err, jwt.ErrExpiredToken) {
+		t.Errorf("expected %v, got %v", jwt.ErrExpiredToken, err)
+	}
+
+	// flip a bit of the decoded signature, as editing the trailing base64
+	// characters may not change the bytes
+	dot := strings.LastIndex(token, ".")
+
+	signature, err := base64.RawURLEncoding.DecodeString(token[dot+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature[0] ^= 0x01
+
+	tampered := token[:dot+1] + base64.RawURLEncoding.EncodeToString(signature)
+
+	_, err = jwt.Verify(tampered, keys, now)
+	if !errors.Is(err, jwt.ErrInvalidToken) {
+		t.Errorf("expected %v for a tampered token, got %v", jwt.ErrInvalidToken, err)
+	}
+
+	rotated, err := jwt.Sign(jwt.Claims{Subject: "11", Expiry: now.Add(time.Hour).Unix()}, "retired", privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = jwt.Verify(rotated, keys, now)
+	if !errors.Is(err, jwt.ErrUnknownKey) {
+		t.Errorf("expected %v, got %v", jwt.ErrUnknownKey, err)
+	}
+}
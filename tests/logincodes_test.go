@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// dialLoginCodeTest connects to the service as the test user, whose emails
+// are caught by a fake notifier.
+func dialLoginCodeTest(t *testing.T) (*grpc.ClientConn, string, *fakeNotifier) {
+	t.Helper()
+
+	email := os.Getenv("AUTH_TEST_USER_EMAIL")
+	if email == "" {
+		t.Skip("AUTH_TEST_USER_EMAIL is not set")
+	}
+
+	notifier := startFakeNotifier(t)
+
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn, email, notifier
+}
+
+// completeLoginCode redeems a login code, waiting out the backoff of earlier
+// wrong codes.
+func completeLoginCode(conn *grpc.ClientConn, req *auth.CompleteLoginCodeRequest) (*auth.LoginResponse, error) {
+	authClient := auth.NewAuthenticationClient(conn)
+
+	for {
+		res, err := authClient.CompleteLoginCode(context.Background(), req)
+
+		delay, ok := retryDelay(err)
+		if !ok || delay > time.Minute {
+			return res, err
+		}
+
+		time.Sleep(delay + time.Second)
+	}
+}
+
+// retryDelay returns the delay a ResourceExhausted error asks for.
+func retryDelay(err error) (time.Duration, bool) {
+	if status.Code(err) != codes.ResourceExhausted {
+		return 0, false
+	}
+
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			return info.RetryDelay.AsDuration(), true
+		}
+	}
+
+	return 0, false
+}
+
+// loginWithCode logs the test user in with an emailed code and returns the
+// login, for methods that require a fresh one.
+func loginWithCode(t *testing.T, conn *grpc.ClientConn, email string, notifier *fakeNotifier) *auth.LoginResponse {
+	t.Helper()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	_, err := authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: email})
+	if err != nil {
+		t.Fatalf("couldn't request a login code: %s", err.Error())
+	}
+
+	codeEmail := notifier.waitForEmail(email, 5*time.Second)
+	if codeEmail == nil {
+		t.Fatal("expected a login code email")
+	}
+
+	res, err := completeLoginCode(conn, &auth.CompleteLoginCodeRequest{Email: email, Code: codeEmail.Data["loginCode"]})
+	if err != nil {
+		t.Fatalf("couldn't log in with the code: %s", err.Error())
+	}
+
+	if res.State != "authenticated" {
+		t.Fatalf("expected an authenticated login, got %q", res.State)
+	}
+
+	return res
+}
+
+func TestLoginCode(t *testing.T) {
+	conn, email, notifier := dialLoginCodeTest(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	_, err := authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: email})
+	if err != nil {
+		t.Fatalf("couldn't request a login code: %s", err.Error())
+	}
+
+	codeEmail := notifier.waitForEmail(email, 5*time.Second)
+	if codeEmail == nil {
+		t.Fatal("expected a login code email")
+	}
+
+	code := codeEmail.Data["loginCode"]
+	if len(code) != 6 {
+		t.Fatalf("expected a 6 digit code, got %q", code)
+	}
+
+	req := &auth.CompleteLoginCodeRequest{Email: email, Code: code}
+
+	res, err := authClient.CompleteLoginCode(context.Background(), req)
+	if err != nil {
+		t.Fatalf("couldn't log in with the code: %s", err.Error())
+	}
+
+	if res.TokenPlaintext == "" {
+		t.Error("expected a token")
+	}
+
+	_, err = authClient.CompleteLoginCode(context.Background(), req)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a spent code to be rejected with %s, got %v", codes.Unauthenticated, err)
+	}
+}
+
+func TestLoginCodeAttemptLimit(t *testing.T) {
+	conn, email, notifier := dialLoginCodeTest(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	_, err := authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: email})
+	if err != nil {
+		t.Fatalf("couldn't request a login code: %s", err.Error())
+	}
+
+	codeEmail := notifier.waitForEmail(email, 5*time.Second)
+	if codeEmail == nil {
+		t.Fatal("expected a login code email")
+	}
+
+	code := codeEmail.Data["loginCode"]
+
+	wrong := "000000"
+	if code == wrong {
+		wrong = "000001"
+	}
+
+	// the default -login-code-max-attempts
+	for i := 0; i < 5; i++ {
+		_, err = completeLoginCode(conn, &auth.CompleteLoginCodeRequest{Email: email, Code: wrong})
+		if status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("attempt %d: expected %s, got %v", i+1, codes.Unauthenticated, err)
+		}
+	}
+
+	_, err = completeLoginCode(conn, &auth.CompleteLoginCodeRequest{Email: email, Code: code})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected the code to be void after too many wrong attempts, got %v", err)
+	}
+
+	// a successful login clears the lockout for the tests after this one
+	loginWithCode(t, conn, email, notifier)
+}
+
+func TestLoginCodeLockoutAcrossCodes(t *testing.T) {
+	conn, email, notifier := dialLoginCodeTest(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	wrong := func(code string) string {
+		if code == "000000" {
+			return "000001"
+		}
+
+		return "000000"
+	}
+
+	// with the default -lockout-backoff-after, three wrong codes back off,
+	// even when each is entered for a new code
+	var err error
+	for i := 0; i < 4; i++ {
+		_, err = authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: email})
+		if err != nil {
+			t.Fatalf("couldn't request a login code: %s", err.Error())
+		}
+
+		codeEmail := notifier.waitForEmail(email, 5*time.Second)
+		if codeEmail == nil {
+			t.Fatal("expected a login code email")
+		}
+
+		_, err = authClient.CompleteLoginCode(context.Background(), &auth.CompleteLoginCodeRequest{Email: email, Code: wrong(codeEmail.Data["loginCode"])})
+		if status.Code(err) == codes.ResourceExhausted {
+			break
+		}
+	}
+
+	if _, ok := retryDelay(err); !ok {
+		t.Errorf("expected wrong codes to add up across codes, got %v", err)
+	}
+
+	loginWithCode(t, conn, email, notifier)
+}
+
+func TestRequestLoginCodeLimit(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	email := fmt.Sprintf("login-code-limit-%d@example.com", time.Now().UnixNano())
+
+	// the default -login-code-max-requests
+	for i := 0; i < 5; i++ {
+		_, err = authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: email})
+		if err != nil {
+			t.Fatalf("request %d: expected success, got %v", i+1, err)
+		}
+	}
+
+	_, err = authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: email})
+	if _, ok := retryDelay(err); !ok {
+		t.Errorf("expected too many requests to be rejected with a retry delay, got %v", err)
+	}
+}
+
+func TestLoginLink(t *testing.T) {
+	conn, email, notifier := dialLoginCodeTest(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	_, err := authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: email, MagicLink: true})
+	if err != nil {
+		t.Fatalf("couldn't request a login link: %s", err.Error())
+	}
+
+	linkEmail := notifier.waitForEmail(email, 5*time.Second)
+	if linkEmail == nil {
+		t.Fatal("expected a login link email")
+	}
+
+	req := &auth.CompleteLoginCodeRequest{Token: linkEmail.Data["loginToken"]}
+
+	_, err = authClient.CompleteLoginCode(context.Background(), req)
+	if err != nil {
+		t.Fatalf("couldn't log in with the link: %s", err.Error())
+	}
+
+	_, err = authClient.CompleteLoginCode(context.Background(), req)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a spent link to be rejected with %s, got %v", codes.Unauthenticated, err)
+	}
+}
+
+func TestRequestLoginCodeUnknownEmail(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	// the response must not tell registered emails apart
+	_, err = authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: fmt.Sprintf("nobody-%d@example.com", time.Now().UnixNano())})
+	if err != nil {
+		t.Errorf("expected success for an unknown email, got %v", err)
+	}
+}
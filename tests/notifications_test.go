@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/saarwasserman/auth/protogen/notifications"
+	"google.golang.org/grpc"
+)
+
+// fakeNotifier stands in for the notifications service the auth service
+// dials on its default -notifications-service-port, and hands every email it
+// is asked to send to the test.
+type fakeNotifier struct {
+	notifications.UnimplementedNotificationsServer
+	sent chan *notifications.EmailRequest
+}
+
+func (f *fakeNotifier) SendEmail(ctx context.Context, req *notifications.EmailRequest) (*notifications.EmailResponse, error) {
+	f.sent <- req
+	return &notifications.EmailResponse{}, nil
+}
+
+func startFakeNotifier(t *testing.T) *fakeNotifier {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "localhost:40010")
+	if err != nil {
+		t.Fatalf("couldn't listen for notifications: %s", err.Error())
+	}
+
+	notifier := &fakeNotifier{sent: make(chan *notifications.EmailRequest, 10)}
+
+	server := grpc.NewServer()
+	notifications.RegisterNotificationsServer(server, notifier)
+
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	return notifier
+}
+
+// waitForEmail returns the next email sent to the recipient, or nil if none
+// arrives before the timeout.
+func (f *fakeNotifier) waitForEmail(recipient string, timeout time.Duration) *notifications.EmailRequest {
+	deadline := time.After(timeout)
+
+	for {
+		select {
+		case email := <-f.sent:
+			if email.Recipient == recipient {
+				return email
+			}
+		case <-deadline:
+			return nil
+		}
+	}
+}
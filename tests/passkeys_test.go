@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/redis/go-redis/v9"
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var b64url = base64.RawURLEncoding
+
+// softAuthenticator is a platform authenticator in software. It holds a
+// single ES256 discoverable credential and always verifies the user.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+// authenticatorData returns the authenticator data with the user present and
+// verified flags set, and the attested credential when attested is set.
+func (a *softAuthenticator) authenticatorData(t *testing.T, rpID string, attested bool) []byte {
+	t.Helper()
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+
+	flags := byte(protocol.FlagUserPresent | protocol.FlagUserVerified)
+	if attested {
+		flags |= byte(protocol.FlagAttestedCredentialData)
+	}
+
+	authData := append(rpIDHash[:], flags)
+	authData = binary.BigEndian.AppendUint32(authData, a.signCount)
+
+	if attested {
+		publicKey, err := webauthncbor.Marshal(map[int]any{
+			1:  2,  // kty: EC2
+			3:  -7, // alg: ES256
+			-1: 1,  // crv: P-256
+			-2: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+			-3: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		authData = append(authData, make([]byte, 16)...) // aaguid
+		authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+		authData = append(authData, a.credentialID...)
+		authData = append(authData, publicKey...)
+	}
+
+	return authData
+}
+
+func clientData(t *testing.T, ceremonyType, challenge, origin string) []byte {
+	t.Helper()
+
+	clientDataJSON, err := json.Marshal(map[string]string{
+		"type":      ceremonyType,
+		"challenge": challenge,
+		"origin":    origin,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clientDataJSON
+}
+
+// create answers PublicKeyCredentialCreationOptions with a "none" attestation
+// of a new credential, as navigator.credentials.create() would.
+func (a *softAuthenticator) create(t *testing.T, options []byte, origin string) []byte {
+	t.Helper()
+
+	var creation struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RP        struct {
+				ID string `json:"id"`
+			} `json:"rp"`
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		} `json:"publicKey"`
+	}
+
+	err := json.Unmarshal(options, &creation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.userHandle, err = b64url.DecodeString(creation.PublicKey.User.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attestationObject, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": a.authenticatorData(t, creation.PublicKey.RP.ID, true),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := json.Marshal(map[string]any{
+		"id":    b64url.EncodeToString(a.credentialID),
+		"rawId": b64url.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url.EncodeToString(clientData(t, "webauthn.create", creation.PublicKey.Challenge, origin)),
+			"attestationObject": b64url.EncodeToString(attestationObject),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return credential
+}
+
+// get answers PublicKeyCredentialRequestOptions with an assertion, as
+// navigator.credentials.get() would, counting the signature.
+func (a *softAuthenticator) get(t *testing.T, options []byte, origin string) []byte {
+	t.Helper()
+
+	var assertion struct {
+		PublicKey struct {
+			Challenge string `json:"challenge"`
+			RPID      string `json:"rpId"`
+		} `json:"publicKey"`
+	}
+
+	err := json.Unmarshal(options, &assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.signCount++
+
+	authData := a.authenticatorData(t, assertion.PublicKey.RPID, false)
+	clientDataJSON := clientData(t, "webauthn.get", assertion.PublicKey.Challenge, origin)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(authData, clientDataHash[:]...))
+
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := json.Marshal(map[string]any{
+		"id":    b64url.EncodeToString(a.credentialID),
+		"rawId": b64url.EncodeToString(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64url.EncodeToString(clientDataJSON),
+			"authenticatorData": b64url.EncodeToString(authData),
+			"signature":         b64url.EncodeToString(signature),
+			"userHandle":        b64url.EncodeToString(a.userHandle),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return credential
+}
+
+// testPasskeyUser is a minimal webauthn.User for checking the software
+// authenticator against the library directly.
+type testPasskeyUser struct {
+	id          []byte
+	credentials []webauthn.Credential
+}
+
+func (u *testPasskeyUser) WebAuthnID() []byte                         { return u.id }
+func (u *testPasskeyUser) WebAuthnName() string                       { return "dana@example.com" }
+func (u *testPasskeyUser) WebAuthnDisplayName() string                { return "Dana" }
+func (u *testPasskeyUser) WebAuthnIcon() string                       { return "" }
+func (u *testPasskeyUser) WebAuthnCredentials() []webauthn.Credential { return u.credentials }
+
+// TestSoftAuthenticator runs both ceremonies against the WebAuthn library with
+// the settings the service uses, so that a failure of TestPasskeyCeremonies
+// is not down to the software authenticator.
+func TestSoftAuthenticator(t *testing.T) {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          "localhost",
+		RPDisplayName: "dinghy",
+		RPOrigins:     []string{"https://localhost"},
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			UserVerification:   protocol.VerificationRequired,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := newSoftAuthenticator(t)
+	user := &testPasskeyUser{id: []byte{0, 0, 0, 0, 0, 0, 0, 11}}
+
+	creation, session, err := w.BeginRegistration(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, _ := json.Marshal(creation)
+
+	parsedCreation, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(authenticator.create(t, options, "https://localhost")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err := w.CreateCredential(user, *session, parsedCreation)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	user.credentials = append(user.credentials, *credential)
+
+	findUser := func(rawID, userHandle []byte) (webauthn.User, error) {
+		if !bytes.Equal(userHandle, user.id) {
+			return nil, errors.New("unknown user")
+		}
+
+		return user, nil
+	}
+
+	assertion, session, err := w.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options, _ = json.Marshal(assertion)
+
+	parsedAssertion, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(authenticator.get(t, options, "https://localhost")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credential, err = w.ValidateDiscoverableLogin(findUser, *session, parsedAssertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if credential.Authenticator.SignCount != 1 || credential.Authenticator.CloneWarning {
+		t.Errorf("expected sign count 1 without a clone warning, got %+v", credential.Authenticator)
+	}
+
+	// an assertion from the wrong origin is rejected
+	assertion, session, _ = w.BeginDiscoverableLogin()
+	options, _ = json.Marshal(assertion)
+
+	parsedAssertion, err = protocol.ParseCredentialRequestResponseBody(bytes.NewReader(authenticator.get(t, options, "https://evil.example")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.ValidateDiscoverableLogin(findUser, *session, parsedAssertion)
+	if err == nil {
+		t.Error("expected an assertion from another origin to be rejected")
+	}
+}
+
+func TestPasskeyChallengeModel(t *testing.T) {
+	server := miniredis.RunT(t)
+
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	m := data.PasskeyChallengeModel{Redis: client}
+	ctx := context.Background()
+
+	id, err := m.Save(ctx, "login", []byte("state"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ceremonies of one kind cannot be finished as the other
+	_, err = m.Take(ctx, "registration", id)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("expected %v, got %v", data.ErrRecordNotFound, err)
+	}
+
+	state, err := m.Take(ctx, "login", id)
+	if err != nil || string(state) != "state" {
+		t.Fatalf("expected the saved state, got %q %v", state, err)
+	}
+
+	_, err = m.Take(ctx, "login", id)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("expected a ceremony to be taken only once, got %v", err)
+	}
+
+	id, err = m.Save(ctx, "login", []byte("state"), time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.FastForward(2 * time.Minute)
+
+	_, err = m.Take(ctx, "login", id)
+	if !errors.Is(err, data.ErrRecordNotFound) {
+		t.Errorf("expected an expired ceremony to be gone, got %v", err)
+	}
+
+	_, err = data.PasskeyChallengeModel{}.Save(ctx, "login", []byte("state"), time.Minute)
+	if !errors.Is(err, data.ErrMissingCache) {
+		t.Errorf("expected %v without redis, got %v", data.ErrMissingCache, err)
+	}
+}
+
+// TestPasskeyCeremonies registers a passkey for the test user and logs in
+// with it. Registration needs a fresh login, done with an email code. It
+// needs the service started with -webauthn-rp-id localhost and
+// -webauthn-rp-origins https://localhost.
+func TestPasskeyCeremonies(t *testing.T) {
+	const origin = "https://localhost"
+
+	conn, email, notifier := dialLoginCodeTest(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	session := loginWithCode(t, conn, email, notifier)
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+session.TokenPlaintext)
+
+	registration, err := authClient.BeginPasskeyRegistration(ctx, &auth.BeginPasskeyRegistrationRequest{})
+	if status.Code(err) == codes.FailedPrecondition {
+		t.Skip("passkeys are not configured")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator := newSoftAuthenticator(t)
+
+	_, err = authClient.FinishPasskeyRegistration(ctx, &auth.FinishPasskeyRegistrationRequest{
+		CeremonyId: registration.CeremonyId,
+		Credential: authenticator.create(t, registration.Options, origin),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login, err := authClient.BeginPasskeyLogin(context.Background(), &auth.BeginPasskeyLoginRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertion := authenticator.get(t, login.Options, origin)
+
+	res, err := authClient.FinishPasskeyLogin(context.Background(), &auth.FinishPasskeyLoginRequest{
+		CeremonyId: login.CeremonyId,
+		Credential: assertion,
+		Client:     "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.UserId != session.UserId || res.State != "authenticated" || res.TokenPlaintext == "" {
+		t.Errorf("expected a session for user %d, got %+v", session.UserId, res)
+	}
+
+	// the challenge is answered already
+	_, err = authClient.FinishPasskeyLogin(context.Background(), &auth.FinishPasskeyLoginRequest{
+		CeremonyId: login.CeremonyId,
+		Credential: assertion,
+	})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected %s for a finished ceremony, got %v", codes.NotFound, err)
+	}
+
+	// a signature that does not advance the sign count is a clone's
+	login, err = authClient.BeginPasskeyLogin(context.Background(), &auth.BeginPasskeyLoginRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authenticator.signCount--
+
+	_, err = authClient.FinishPasskeyLogin(context.Background(), &auth.FinishPasskeyLoginRequest{
+		CeremonyId: login.CeremonyId,
+		Credential: authenticator.get(t, login.Options, origin),
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected %s for a stale sign count, got %v", codes.Unauthenticated, err)
+	}
+}
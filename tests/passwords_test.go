@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestSetPasswordRequiresAuthentication(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	_, err = authClient.SetPassword(context.Background(), &auth.SetPasswordRequest{
+		UserId:   11,
+		Password: "pa55word-for-eleven",
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected %s, got %v", codes.Unauthenticated, err)
+	}
+}
+
+func TestChangePasswordWrongCurrentPassword(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	// a user of its own, as wrong passwords count towards its lockout, and a
+	// password-change token, as sessions without a recent login are stepped up
+	token := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopePasswordChange, UserId: 1<<40 + rand.Int64N(1<<40)})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+token.TokenPlaintext)
+
+	_, err = authClient.ChangePassword(ctx, &auth.ChangePasswordRequest{
+		CurrentPassword: "not-the-password",
+		NewPassword:     "a-brand-new-pa55word",
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected %s, got %v", codes.Unauthenticated, err)
+	}
+
+	// with the default -lockout-backoff-after the fourth attempt backs off
+	for attempt := 2; attempt <= 4; attempt++ {
+		_, err = authClient.ChangePassword(ctx, &auth.ChangePasswordRequest{
+			CurrentPassword: "not-the-password",
+			NewPassword:     "a-brand-new-pa55word",
+		})
+		if status.Code(err) == codes.ResourceExhausted {
+			break
+		}
+	}
+
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("expected wrong current passwords to back off with %s, got %v", codes.ResourceExhausted, err)
+	}
+}
+
+func TestRequestPasswordResetUnknownEmail(t *testing.T) {
+	notifier := startFakeNotifier(t)
+
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	_, err = authClient.RequestPasswordReset(context.Background(), &auth.RequestPasswordResetRequest{
+		Email: "no-such-user@example.com",
+	})
+	if err != nil {
+		t.Fatalf("expected an unknown email to be accepted: %s", err.Error())
+	}
+
+	if email := notifier.waitForEmail("no-such-user@example.com", time.Second); email != nil {
+		t.Errorf("expected no email for an unknown user, got %s", email.TemplateFile)
+	}
+}
+
+// TestPasswordReset needs an activated user whose email is given in
+// AUTH_TEST_USER_EMAIL. The user's password is changed by the test.
+func TestPasswordReset(t *testing.T) {
+	email := os.Getenv("AUTH_TEST_USER_EMAIL")
+	if email == "" {
+		t.Skip("AUTH_TEST_USER_EMAIL is not set")
+	}
+
+	notifier := startFakeNotifier(t)
+
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	_, err = authClient.RequestPasswordReset(context.Background(), &auth.RequestPasswordResetRequest{Email: email})
+	if err != nil {
+		t.Fatalf("couldn't request a password reset: %s", err.Error())
+	}
+
+	resetEmail := notifier.waitForEmail(email, 5*time.Second)
+	if resetEmail == nil {
+		t.Fatal("expected a password reset email")
+	}
+
+	req := &auth.ResetPasswordRequest{
+		TokenPlaintext: resetEmail.Data["passwordResetToken"],
+		// a new password every run, as the current one cannot be kept
+		NewPassword: fmt.Sprintf("pa55word-after-reset-%d", time.Now().UnixNano()),
+	}
+
+	_, err = authClient.ResetPassword(context.Background(), req)
+	if err != nil {
+		t.Fatalf("couldn't reset password: %s", err.Error())
+	}
+
+	_, err = authClient.ResetPassword(context.Background(), req)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a spent reset token to be rejected with %s, got %v", codes.Unauthenticated, err)
+	}
+
+	_, err = authClient.Login(context.Background(), &auth.LoginRequest{
+		Email:    email,
+		Password: req.NewPassword,
+	})
+	if err != nil {
+		t.Errorf("expected to log in with the new password: %s", err.Error())
+	}
+}
+
+func TestPasswordChangeTokenScope(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	token := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopePasswordChange, UserId: 11})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+token.TokenPlaintext)
+
+	// every authenticated method but ChangePassword refuses the token
+	calls := map[string]func() error{
+		"ListSessions": func() error {
+			_, err := authClient.ListSessions(ctx, &auth.ListSessionsRequest{})
+			return err
+		},
+		"RevokeSession": func() error {
+			_, err := authClient.RevokeSession(ctx, &auth.RevokeSessionRequest{})
+			return err
+		},
+		"RevokeOtherSessions": func() error {
+			_, err := authClient.RevokeOtherSessions(ctx, &auth.RevokeOtherSessionsRequest{})
+			return err
+		},
+		"SetPassword": func() error {
+			_, err := authClient.SetPassword(ctx, &auth.SetPasswordRequest{})
+			return err
+		},
+		"UnlockAccount": func() error {
+			_, err := authClient.UnlockAccount(ctx, &auth.UnlockAccountRequest{})
+			return err
+		},
+		"BeginTotpEnrollment": func() error {
+			_, err := authClient.BeginTotpEnrollment(ctx, &auth.BeginTotpEnrollmentRequest{})
+			return err
+		},
+		"ConfirmTotpEnrollment": func() error {
+			_, err := authClient.ConfirmTotpEnrollment(ctx, &auth.ConfirmTotpEnrollmentRequest{})
+			return err
+		},
+		"DisableTotp": func() error {
+			_, err := authClient.DisableTotp(ctx, &auth.DisableTotpRequest{})
+			return err
+		},
+		"VerifyTotp": func() error {
+			_, err := authClient.VerifyTotp(ctx, &auth.VerifyTotpRequest{})
+			return err
+		},
+		"RegenerateRecoveryCodes": func() error {
+			_, err := authClient.RegenerateRecoveryCodes(ctx, &auth.RegenerateRecoveryCodesRequest{})
+			return err
+		},
+		"BeginPasskeyRegistration": func() error {
+			_, err := authClient.BeginPasskeyRegistration(ctx, &auth.BeginPasskeyRegistrationRequest{})
+			return err
+		},
+		"FinishPasskeyRegistration": func() error {
+			_, err := authClient.FinishPasskeyRegistration(ctx, &auth.FinishPasskeyRegistrationRequest{})
+			return err
+		},
+	}
+
+	for method, call := range calls {
+		err := call()
+		if status.Code(err) != codes.Unauthenticated || stepUpErrorInfo(err) != nil {
+			t.Errorf("%s: expected a password-change token to be rejected with %s, got %v", method, codes.Unauthenticated, err)
+		}
+	}
+
+	_, err = authClient.Authenticate(context.Background(), &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeAuthentication,
+		TokenPlaintext: token.TokenPlaintext,
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Authenticate to reject a password-change token with %s, got %v", codes.Unauthenticated, err)
+	}
+
+	// an invalid request only comes back once the token is accepted
+	_, err = authClient.ChangePassword(ctx, &auth.ChangePasswordRequest{NewPassword: "a-brand-new-pa55word"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected a password-change token to be accepted by ChangePassword, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/validator"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := data.PasswordPolicy{
+		MinLength:             10,
+		MaxLength:             1024,
+		MinCharacterClasses:   3,
+		MaxRepeatedCharacters: 2,
+		ForbidPersonalInfo:    true,
+		MinStrength:           3,
+		DenyList:              map[string]struct{}{"correcthorsebattery": {}},
+	}
+
+	user := &data.User{Name: "Dana Scully", Email: "dana@example.com"}
+
+	tests := []struct {
+		password string
+		failed   []string
+	}{
+		{"Kq7#vLm2!xRt", nil},
+		{"short", []string{"password.min_length", "password.character_classes", "password.strength"}},
+		{"Dana-2024-paaass", []string{"password.repeated_characters", "password.personal_info"}},
+		{"scully-X-2024-rocks", []string{"password.personal_info"}},
+		{"CorrectHorseBattery", []string{"password.character_classes", "password.deny_list"}},
+	}
+
+	for _, tt := range tests {
+		v := validator.New()
+		policy.Validate(v, "password", tt.password, user)
+
+		for _, key := range tt.failed {
+			if _, ok := v.Errors[key]; !ok {
+				t.Errorf("%q: expected a %s violation, got %v", tt.password, key, v.Errors)
+			}
+		}
+
+		if tt.failed == nil && !v.Valid() {
+			t.Errorf("%q: expected no violations, got %v", tt.password, v.Errors)
+		}
+	}
+}
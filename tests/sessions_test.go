@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRevokeOtherSessions(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	laptop := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11, Client: "laptop"})
+
+	phone := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11, Client: "phone"})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+phone.TokenPlaintext)
+
+	res, err := authClient.ListSessions(ctx, &auth.ListSessionsRequest{})
+	if err != nil {
+		t.Fatalf("couldn't list sessions: %s", err.Error())
+	}
+
+	found := false
+	for _, session := range res.Sessions {
+		if session.SessionId == phone.SessionId {
+			found = session.Current
+		}
+	}
+
+	if !found {
+		t.Errorf("expected session %s to be listed as current", phone.SessionId)
+	}
+
+	_, err = authClient.RevokeOtherSessions(ctx, &auth.RevokeOtherSessionsRequest{})
+	if err != nil {
+		t.Fatalf("couldn't revoke sessions: %s", err.Error())
+	}
+
+	_, err = authClient.Authenticate(context.Background(), &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeAuthentication,
+		TokenPlaintext: laptop.TokenPlaintext,
+	})
+	if err == nil {
+		t.Errorf("expected the other session to be revoked")
+	}
+
+	_, err = authClient.Authenticate(context.Background(), &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeAuthentication,
+		TokenPlaintext: phone.TokenPlaintext,
+	})
+	if err != nil {
+		t.Errorf("expected the current session to remain valid: %s", err.Error())
+	}
+}
+
+func TestSessionPolicy(t *testing.T) {
+	policy := data.SessionPolicy{InactivityTime: 5 * time.Minute, MaxLifetime: 24 * time.Hour}
+	now := time.Now()
+
+	tests := []struct {
+		name      string
+		createdAt time.Duration
+		lastUsed  time.Duration
+		access    error
+		lifetime  error
+	}{
+		{"active", time.Hour, time.Minute, nil, nil},
+		{"idle", time.Hour, 6 * time.Minute, data.ErrSessionInactive, nil},
+		{"too old", 25 * time.Hour, time.Minute, data.ErrSessionExpired, data.ErrSessionExpired},
+	}
+
+	for _, tt := range tests {
+		token := &data.Token{CreatedAt: now.Add(-tt.createdAt), LastUsedAt: now.Add(-tt.lastUsed)}
+
+		if err := policy.CheckAccess(token, now); !errors.Is(err, tt.access) {
+			t.Errorf("%s: expected access check %v, got %v", tt.name, tt.access, err)
+		}
+
+		if err := policy.CheckLifetime(token, now); !errors.Is(err, tt.lifetime) {
+			t.Errorf("%s: expected lifetime check %v, got %v", tt.name, tt.lifetime, err)
+		}
+	}
+
+	idle := &data.Token{CreatedAt: now, LastUsedAt: now.Add(-time.Hour)}
+	if err := (data.SessionPolicy{}).CheckAccess(idle, now); err != nil {
+		t.Errorf("expected a zero policy to accept any token, got %v", err)
+	}
+}
+
+func TestSessionPolicyAccessExpiry(t *testing.T) {
+	policy := data.SessionPolicy{InactivityTime: 5 * time.Minute, MaxLifetime: 24 * time.Hour}
+	now := time.Now()
+
+	// signed tokens lapse when idle as long as opaque ones would
+	session := &data.Session{CreatedAt: now}
+	if expiry := policy.AccessExpiry(session, now.Add(time.Hour), now); !expiry.Equal(now.Add(5 * time.Minute)) {
+		t.Errorf("expected the expiry capped at the inactivity time, got %s", expiry.Sub(now))
+	}
+
+	// and never outlive their session
+	session = &data.Session{CreatedAt: now.Add(-24*time.Hour + time.Minute)}
+	if expiry := policy.AccessExpiry(session, now.Add(time.Hour), now); !expiry.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the expiry capped at the session lifetime, got %s", expiry.Sub(now))
+	}
+
+	if expiry := policy.AccessExpiry(session, now.Add(time.Minute/2), now); !expiry.Equal(now.Add(time.Minute / 2)) {
+		t.Errorf("expected a shorter expiry to be kept, got %s", expiry.Sub(now))
+	}
+}
+
+func TestSessionModelDeleteOldest(t *testing.T) {
+	db := openTestDB(t)
+
+	tokens := data.TokenModel{DB: db, Scopes: data.DefaultTokenScopes}
+	sessions := data.SessionModel{DB: db}
+
+	userID := 1<<40 + rand.Int64N(1<<40)
+	t.Cleanup(func() { db.Exec("DELETE FROM tokens WHERE user_id = $1", userID) })
+
+	// two live sessions, then an expired and a spent one, newest last
+	var ids []string
+	for i := 4; i > 0; i-- {
+		session, err := data.NewSession("test", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.CreatedAt = time.Now().Add(-time.Duration(i) * time.Hour)
+
+		_, err = tokens.NewForSession(userID, time.Hour, data.ScopeAuthentication, session)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ids = append(ids, session.ID)
+	}
+
+	_, err := db.Exec("UPDATE tokens SET expiry = NOW() - INTERVAL '1 minute' WHERE session_id = $1", ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.Exec("UPDATE tokens SET used = true WHERE session_id = $1", ids[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// dead sessions do not count towards the limit
+	err = sessions.DeleteOldestForUser(userID, 2)
+	if err != nil {
+		t.Fatalf("couldn't delete the oldest sessions: %s", err.Error())
+	}
+
+	live, err := sessions.GetAllForUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(live) != 2 {
+		t.Fatalf("expected both live sessions to be kept, got %d", len(live))
+	}
+
+	err = sessions.DeleteOldestForUser(userID, 1)
+	if err != nil {
+		t.Fatalf("couldn't delete the oldest sessions: %s", err.Error())
+	}
+
+	live, err = sessions.GetAllForUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(live) != 1 || live[0].ID != ids[1] {
+		t.Errorf("expected only the newest live session to remain, got %v", live)
+	}
+}
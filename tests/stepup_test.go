@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log"
+	"testing"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// stepUpErrorInfo returns the ErrorInfo of an insufficient authentication
+// error, or nil when err is not one.
+func stepUpErrorInfo(err error) *errdetails.ErrorInfo {
+	if status.Code(err) != codes.Unauthenticated {
+		return nil
+	}
+
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason == "INSUFFICIENT_USER_AUTHENTICATION" {
+			return info
+		}
+	}
+
+	return nil
+}
+
+func TestStepUpWithoutLogin(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	// CreateToken sessions have no login behind them
+	token := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11})
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+token.TokenPlaintext)
+
+	_, err = authClient.RegenerateRecoveryCodes(ctx, &auth.RegenerateRecoveryCodesRequest{})
+
+	info := stepUpErrorInfo(err)
+	if info == nil {
+		t.Fatalf("expected an insufficient authentication error, got %v", err)
+	}
+
+	if info.Metadata["acr_values"] != "aal2" || info.Metadata["acr"] != "" || info.Metadata["max_age"] == "" {
+		t.Errorf("unexpected step-up details %v", info.Metadata)
+	}
+
+	// changing credentials needs a recent login of any strength
+	calls := map[string]func() error{
+		"ChangePassword": func() error {
+			_, err := authClient.ChangePassword(ctx, &auth.ChangePasswordRequest{})
+			return err
+		},
+		"BeginTotpEnrollment": func() error {
+			_, err := authClient.BeginTotpEnrollment(ctx, &auth.BeginTotpEnrollmentRequest{})
+			return err
+		},
+		"ConfirmTotpEnrollment": func() error {
+			_, err := authClient.ConfirmTotpEnrollment(ctx, &auth.ConfirmTotpEnrollmentRequest{})
+			return err
+		},
+		"BeginPasskeyRegistration": func() error {
+			_, err := authClient.BeginPasskeyRegistration(ctx, &auth.BeginPasskeyRegistrationRequest{})
+			return err
+		},
+	}
+
+	for method, call := range calls {
+		info := stepUpErrorInfo(call())
+		if info == nil || info.Metadata["acr_values"] != "aal1" {
+			t.Errorf("%s: expected a login to be required, got %v", method, info)
+		}
+	}
+
+	// other methods take the same token
+	_, err = authClient.ListSessions(ctx, &auth.ListSessionsRequest{})
+	if err != nil {
+		t.Errorf("expected a plain method to accept the token, got %v", err)
+	}
+}
+
+func TestStepUpSingleFactor(t *testing.T) {
+	introspectionCtx := introspectionContext(t)
+
+	conn, email, notifier := dialLoginCodeTest(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	session := loginWithCode(t, conn, email, notifier)
+
+	res, err := authClient.IntrospectToken(introspectionCtx, &auth.IntrospectTokenRequest{TokenPlaintext: session.TokenPlaintext})
+	if err != nil {
+		t.Fatalf("couldn't introspect token: %s", err.Error())
+	}
+
+	if res.Acr != "aal1" || len(res.Amr) != 1 || res.Amr[0] != data.AuthMethodEmail || res.AuthTime == 0 {
+		t.Errorf("expected an email login, got acr %q amr %v auth_time %d", res.Acr, res.Amr, res.AuthTime)
+	}
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+session.TokenPlaintext)
+
+	_, err = authClient.RegenerateRecoveryCodes(ctx, &auth.RegenerateRecoveryCodesRequest{})
+
+	info := stepUpErrorInfo(err)
+	if info == nil || info.Metadata["acr"] != "aal1" || info.Metadata["acr_values"] != "aal2" {
+		t.Errorf("expected a single factor to need stepping up, got %v", err)
+	}
+}
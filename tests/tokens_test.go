@@ -2,18 +2,48 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/saarwasserman/auth/internal/data"
 	"github.com/saarwasserman/auth/protogen/auth"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
 )
 
+// createToken issues a token on the internal listener, which the service
+// serves on -internal-addr localhost:40022, like the services in front of it.
+func createToken(t *testing.T, req *auth.TokenCreationRequest) *auth.TokenCreationResponse {
+	t.Helper()
+
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+
+	conn, err := grpc.NewClient("localhost:40022", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+	}
+	defer conn.Close()
+
+	res, err := auth.NewAuthenticationClient(conn).CreateToken(context.Background(), req)
+	if err != nil {
+		t.Fatalf("couldn't create token: %s", err.Error())
+	}
+
+	return res
+}
+
 func TestCreateToken(t *testing.T) {
 	var opts []grpc.DialOption
 	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
 
 	conn, err := grpc.NewClient("localhost:40020", opts...)
 	if err != nil {
@@ -24,13 +54,308 @@ func TestCreateToken(t *testing.T) {
 
 	authClient := auth.NewAuthenticationClient(conn)
 
-	res, err := authClient.CreateToken(context.Background(), &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11})
+	res := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11})
+
+	if len(res.TokenPlaintext) != 26 {
+		t.Errorf("token length is not equal to 26")
+	}
+
+	// the public listener must not mint or revoke tokens or grant permissions
+	_, err = authClient.CreateToken(context.Background(), &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected CreateToken on the public listener to fail with %s, got %v", codes.PermissionDenied, err)
+	}
+
+	_, err = authClient.DeleteAllTokensForUser(context.Background(), &auth.TokensDeletionRequest{Scope: data.ScopeAuthentication, UserId: 11})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected DeleteAllTokensForUser on the public listener to fail with %s, got %v", codes.PermissionDenied, err)
+	}
+
+	_, err = authClient.AddPermissionForUser(context.Background(), &auth.AddPermissionForUserRequest{UserId: 11, Codes: []string{"credentials:write"}})
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected AddPermissionForUser on the public listener to fail with %s, got %v", codes.PermissionDenied, err)
+	}
+}
+
+func TestRefreshTokenReuse(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
 	if err != nil {
-		log.Fatal("couldn't create token", err.Error())
+		log.Fatalf("fail to dial: %v", err)
 		return
 	}
+	defer conn.Close()
 
-	if len(res.TokenPlaintext) != 26 {
-		t.Errorf("token length is not equal to 26")
+	authClient := auth.NewAuthenticationClient(conn)
+
+	res := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11})
+
+	rotated, err := authClient.RefreshToken(context.Background(), &auth.RefreshTokenRequest{RefreshTokenPlaintext: res.RefreshTokenPlaintext})
+	if err != nil {
+		t.Fatalf("couldn't refresh token: %s", err.Error())
+	}
+
+	// presenting the first refresh token again must revoke the whole family
+	_, err = authClient.RefreshToken(context.Background(), &auth.RefreshTokenRequest{RefreshTokenPlaintext: res.RefreshTokenPlaintext})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected %s on reuse, got %v", codes.Unauthenticated, err)
+	}
+
+	_, err = authClient.RefreshToken(context.Background(), &auth.RefreshTokenRequest{RefreshTokenPlaintext: rotated.RefreshTokenPlaintext})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected rotated refresh token to be revoked, got %v", err)
+	}
+}
+
+func TestRefreshIdleSession(t *testing.T) {
+	db := openTestDB(t)
+
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	res := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11})
+
+	// idle for longer than the default -session-inactivity-time
+	_, err = db.Exec("UPDATE tokens SET last_used_at = NOW() - INTERVAL '1 hour' WHERE session_id = $1", res.SessionId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = authClient.RefreshToken(context.Background(), &auth.RefreshTokenRequest{RefreshTokenPlaintext: res.RefreshTokenPlaintext})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected an idle session to fail to refresh with %s, got %v", codes.Unauthenticated, err)
+	}
+}
+
+func TestConcurrentSessions(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	laptop := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11, Client: "laptop"})
+
+	phone := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11, Client: "phone"})
+
+	if laptop.SessionId == phone.SessionId {
+		t.Errorf("expected distinct sessions, got %s twice", laptop.SessionId)
+	}
+
+	// logging in on the phone must not log the laptop out
+	_, err = authClient.Authenticate(context.Background(), &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeAuthentication,
+		TokenPlaintext: laptop.TokenPlaintext,
+	})
+	if err != nil {
+		t.Errorf("expected first session to remain valid: %s", err.Error())
+	}
+}
+
+func TestAuthenticateAccessScopesOnly(t *testing.T) {
+	var opts []grpc.DialOption
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	opts = append(opts, testClientAddress())
+
+	conn, err := grpc.NewClient("localhost:40020", opts...)
+	if err != nil {
+		log.Fatalf("fail to dial: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	authClient := auth.NewAuthenticationClient(conn)
+
+	res := createToken(t, &auth.TokenCreationRequest{Scope: data.ScopeAuthentication, UserId: 11})
+
+	_, err = authClient.Authenticate(context.Background(), &auth.AuthenticationRequest{TokenScope: data.ScopeAuthentication, TokenPlaintext: res.TokenPlaintext})
+	if err != nil {
+		t.Fatalf("couldn't authenticate the access token: %s", err.Error())
+	}
+
+	_, err = authClient.Authenticate(context.Background(), &auth.AuthenticationRequest{TokenScope: data.ScopeRefresh, TokenPlaintext: res.RefreshTokenPlaintext})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("expected %s for a refresh token, got %v", codes.InvalidArgument, err)
+	}
+
+	// the check must not have spent the refresh token
+	_, err = authClient.RefreshToken(context.Background(), &auth.RefreshTokenRequest{RefreshTokenPlaintext: res.RefreshTokenPlaintext})
+	if err != nil {
+		t.Errorf("expected the refresh token to still work, got %v", err)
+	}
+}
+
+func TestTokenScopeLifetime(t *testing.T) {
+	scope := data.TokenScope{TTL: time.Hour, Size: 16}
+
+	tests := []struct {
+		requested time.Duration
+		expected  time.Duration
+	}{
+		{0, time.Hour},
+		{-time.Minute, time.Hour},
+		{time.Minute, time.Minute},
+		{2 * time.Hour, time.Hour},
+	}
+
+	for _, tt := range tests {
+		if lifetime := scope.Lifetime(tt.requested); lifetime != tt.expected {
+			t.Errorf("requested %s: expected %s, got %s", tt.requested, tt.expected, lifetime)
+		}
+	}
+
+	// scopes without a ttl never cap
+	if lifetime := (data.TokenScope{Size: 32}).Lifetime(24 * time.Hour); lifetime != 24*time.Hour {
+		t.Errorf("expected the requested ttl without a scope ttl, got %s", lifetime)
+	}
+}
+
+func TestLoadTokenScopes(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "scopes.json")
+
+	err := os.WriteFile(configFile, []byte(`{
+		"password-reset": {"ttl": "30m", "size": 32},
+		"invite": {"ttl": "72h", "single-use": true}
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scopes, err := data.LoadTokenScopes(configFile, []string{"password-reset:ttl=20m"})
+	if err != nil {
+		t.Fatalf("couldn't load token scopes: %s", err.Error())
+	}
+
+	// flags apply on top of the file, which applies on top of the defaults
+	reset := scopes[data.ScopePasswordReset]
+	if reset.TTL != 20*time.Minute || reset.Size != 32 || !reset.SingleUse {
+		t.Errorf("unexpected password-reset scope %+v", reset)
+	}
+
+	invite := scopes["invite"]
+	if invite.TTL != 72*time.Hour || invite.Size != 16 || !invite.SingleUse {
+		t.Errorf("unexpected invite scope %+v", invite)
+	}
+
+	if scopes[data.ScopeAuthentication] != data.DefaultTokenScopes[data.ScopeAuthentication] {
+		t.Errorf("expected untouched scopes to keep their defaults, got %+v", scopes[data.ScopeAuthentication])
+	}
+
+	invalid := []string{
+		"password-reset:size=8",
+		"password-reset:ttl=-1m",
+		"password-reset:colour=red",
+		"password-reset",
+		"authentication:single-use=true",
+	}
+
+	for _, override := range invalid {
+		if _, err := data.LoadTokenScopes("", []string{override}); err == nil {
+			t.Errorf("expected %q to be rejected", override)
+		}
+	}
+
+	// a misspelt setting in the file fails rather than being ignored
+	err = os.WriteFile(configFile, []byte(`{"password-reset": {"single_use": false}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := data.LoadTokenScopes(configFile, nil); err == nil {
+		t.Error("expected single_use in the config file to be rejected")
+	}
+}
+
+func TestTokenModelDeleteExpired(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	m := data.TokenModel{DB: db, Scopes: data.DefaultTokenScopes}
+
+	// ids far above any real user's
+	userID := 1<<40 + rand.Int64N(1<<40)
+	t.Cleanup(func() { db.Exec("DELETE FROM tokens WHERE user_id = $1", userID) })
+
+	for i := 0; i < 5; i++ {
+		_, err := m.New(userID, time.Hour, data.ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, err := db.Exec("UPDATE tokens SET expiry = NOW() - INTERVAL '1 minute' WHERE user_id = $1", userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live, err := m.New(userID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// batches smaller than the expired tokens must keep going
+	deleted, err := m.DeleteExpired(ctx, 2)
+	if errors.Is(err, data.ErrLockHeld) {
+		t.Skip("a running service is reaping")
+	}
+	if err != nil {
+		t.Fatalf("couldn't delete expired tokens: %s", err.Error())
+	}
+
+	if deleted < 5 {
+		t.Errorf("expected at least 5 deleted tokens, got %d", deleted)
+	}
+
+	var remaining int
+	err = db.QueryRow("SELECT COUNT(*) FROM tokens WHERE user_id = $1", userID).Scan(&remaining)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if remaining != 1 {
+		t.Errorf("expected only the live token to remain, got %d tokens", remaining)
+	}
+
+	if _, err := m.GetForPlaintext(live.Plaintext); err != nil {
+		t.Errorf("expected the live token to survive, got %v", err)
+	}
+
+	// another replica holding the reaper lock, see internal/data/locks.go
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	var locked bool
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(40020001)").Scan(&locked)
+	if err != nil || !locked {
+		t.Fatalf("couldn't take the reaper lock: %v", err)
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock(40020001)")
+
+	_, err = m.DeleteExpired(ctx, 2)
+	if !errors.Is(err, data.ErrLockHeld) {
+		t.Errorf("expected %v while another session reaps, got %v", data.ErrLockHeld, err)
 	}
 }
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/saarwasserman/auth/internal/data"
+	"github.com/saarwasserman/auth/internal/totp"
+	"github.com/saarwasserman/auth/protogen/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// the SHA-1 secret of the RFC 6238 test vectors, base32 encoded
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTotpCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := totp.Code(rfcSecret, totp.Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if code != tt.code {
+			t.Errorf("at %d: expected %s, got %s", tt.unix, tt.code, code)
+		}
+	}
+}
+
+func TestTotpValidate(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+
+	previous, _ := totp.Code(rfcSecret, totp.Step(now)-1)
+	stale, _ := totp.Code(rfcSecret, totp.Step(now)-2)
+
+	step, ok := totp.Validate(rfcSecret, previous, now, 1)
+	if !ok || step != totp.Step(now)-1 {
+		t.Errorf("expected a code from the previous step to be accepted at step %d, got %d %v", totp.Step(now)-1, step, ok)
+	}
+
+	if _, ok := totp.Validate(rfcSecret, stale, now, 1); ok {
+		t.Error("expected a code from two steps ago to be rejected")
+	}
+
+	if _, ok := totp.Validate(rfcSecret, "12345", now, 1); ok {
+		t.Error("expected a short code to be rejected")
+	}
+}
+
+func TestTotpURI(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uri, err := url.Parse(totp.URI("dinghy", "dana@example.com", secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri.Scheme != "otpauth" || uri.Host != "totp" {
+		t.Errorf("unexpected uri %s", uri)
+	}
+
+	if uri.Query().Get("secret") != secret || uri.Query().Get("issuer") != "dinghy" {
+		t.Errorf("expected the secret and issuer in %s", uri)
+	}
+}
+
+func TestTotpModel(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	key := make([]byte, 32)
+	crand.Read(key)
+
+	m := data.TotpModel{DB: db, Key: key}
+
+	userID := 1<<40 + rand.Int64N(1<<40)
+	t.Cleanup(func() { db.Exec("DELETE FROM totp_secrets WHERE user_id = $1", userID) })
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.InsertPending(ctx, userID, secret)
+	if err != nil {
+		t.Fatalf("couldn't insert a pending secret: %s", err.Error())
+	}
+
+	var stored []byte
+	err = db.QueryRow("SELECT secret FROM totp_secrets WHERE user_id = $1", userID).Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stored, []byte(secret)) {
+		t.Error("expected the secret to be stored encrypted")
+	}
+
+	pending, err := m.GetForUser(ctx, userID)
+	if err != nil {
+		t.Fatalf("couldn't get the secret: %s", err.Error())
+	}
+
+	if pending.Secret != secret || pending.Confirmed {
+		t.Errorf("expected the pending secret to decrypt to the original, got %+v", pending)
+	}
+
+	step := totp.Step(time.Now())
+
+	// the first code confirms the secret
+	err = m.UseStep(ctx, userID, step)
+	if err != nil {
+		t.Fatalf("couldn't use a step: %s", err.Error())
+	}
+
+	enabled, err := m.Enabled(ctx, userID)
+	if err != nil || !enabled {
+		t.Errorf("expected the secret to be confirmed, got %v err=%v", enabled, err)
+	}
+
+	// a code of the same window, or an earlier one, is a replay
+	for _, replayed := range []int64{step, step - 1} {
+		err = m.UseStep(ctx, userID, replayed)
+		if !errors.Is(err, data.ErrTotpStepUsed) {
+			t.Errorf("step %d: expected %v, got %v", replayed, data.ErrTotpStepUsed, err)
+		}
+	}
+
+	err = m.UseStep(ctx, userID, step+1)
+	if err != nil {
+		t.Errorf("expected the next step to be accepted, got %v", err)
+	}
+
+	err = m.InsertPending(ctx, userID, secret)
+	if !errors.Is(err, data.ErrTotpEnabled) {
+		t.Errorf("expected %v once confirmed, got %v", data.ErrTotpEnabled, err)
+	}
+
+	_, err = data.TotpModel{DB: db, Key: make([]byte, 32)}.GetForUser(ctx, userID)
+	if !errors.Is(err, data.ErrInvalidCiphertext) {
+		t.Errorf("expected %v under another key, got %v", data.ErrInvalidCiphertext, err)
+	}
+
+	// a secret copied into another user's row does not open there
+	otherUserID := userID + 1
+	t.Cleanup(func() { db.Exec("DELETE FROM totp_secrets WHERE user_id = $1", otherUserID) })
+
+	_, err = db.Exec("INSERT INTO totp_secrets (user_id, secret, confirmed) SELECT $2, secret, confirmed FROM totp_secrets WHERE user_id = $1", userID, otherUserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.GetForUser(ctx, otherUserID)
+	if !errors.Is(err, data.ErrInvalidCiphertext) {
+		t.Errorf("expected %v for a secret moved to another user, got %v", data.ErrInvalidCiphertext, err)
+	}
+
+	_, err = data.TotpModel{DB: db}.GetForUser(ctx, userID)
+	if !errors.Is(err, data.ErrMissingTotpKey) {
+		t.Errorf("expected %v without a key, got %v", data.ErrMissingTotpKey, err)
+	}
+}
+
+// enrollTotp enables TOTP for the caller of ctx, the user with the given id,
+// and returns the code that confirmed it and the recovery codes. The other
+// tests log the user in with one factor, so it is removed again afterwards.
+func enrollTotp(t *testing.T, conn *grpc.ClientConn, ctx context.Context, userId int64) (string, []string) {
+	t.Helper()
+
+	db := openTestDB(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	t.Cleanup(func() {
+		db.Exec("DELETE FROM totp_secrets WHERE user_id = $1", userId)
+		db.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userId)
+	})
+
+	enrollment, err := authClient.BeginTotpEnrollment(ctx, &auth.BeginTotpEnrollmentRequest{})
+	if status.Code(err) == codes.FailedPrecondition {
+		t.Skip("totp is not configured")
+	}
+	if err != nil {
+		t.Fatalf("couldn't begin totp enrollment: %s", err.Error())
+	}
+
+	code, err := totp.Code(enrollment.Secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirmation, err := authClient.ConfirmTotpEnrollment(ctx, &auth.ConfirmTotpEnrollmentRequest{Code: code})
+	if err != nil {
+		t.Fatalf("couldn't confirm totp enrollment: %s", err.Error())
+	}
+
+	if len(confirmation.RecoveryCodes) < 2 {
+		t.Fatalf("expected recovery codes, got %v", confirmation.RecoveryCodes)
+	}
+
+	return code, confirmation.RecoveryCodes
+}
+
+func TestTotpLogin(t *testing.T) {
+	conn, email, notifier := dialLoginCodeTest(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	session := loginWithCode(t, conn, email, notifier)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+session.TokenPlaintext)
+
+	code, recoveryCodes := enrollTotp(t, conn, ctx, session.UserId)
+
+	// the first factor now only gets an mfa-pending token
+	_, err := authClient.RequestLoginCode(context.Background(), &auth.RequestLoginCodeRequest{Email: email})
+	if err != nil {
+		t.Fatalf("couldn't request a login code: %s", err.Error())
+	}
+
+	codeEmail := notifier.waitForEmail(email, 5*time.Second)
+	if codeEmail == nil {
+		t.Fatal("expected a login code email")
+	}
+
+	pending, err := completeLoginCode(conn, &auth.CompleteLoginCodeRequest{Email: email, Code: codeEmail.Data["loginCode"]})
+	if err != nil {
+		t.Fatalf("couldn't log in with the code: %s", err.Error())
+	}
+
+	if pending.State != "mfa_pending" || pending.RefreshTokenPlaintext != "" {
+		t.Fatalf("expected an mfa-pending login, got %q", pending.State)
+	}
+
+	pendingCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+pending.TokenPlaintext)
+
+	_, err = authClient.ListSessions(pendingCtx, &auth.ListSessionsRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected an mfa-pending token to be rejected with %s, got %v", codes.Unauthenticated, err)
+	}
+
+	_, err = authClient.ChangePassword(pendingCtx, &auth.ChangePasswordRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected ChangePassword to reject an mfa-pending token with %s, got %v", codes.Unauthenticated, err)
+	}
+
+	_, err = authClient.Authenticate(context.Background(), &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeAuthentication,
+		TokenPlaintext: pending.TokenPlaintext,
+	})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected Authenticate to reject an mfa-pending token with %s, got %v", codes.Unauthenticated, err)
+	}
+
+	// the code that confirmed the enrollment cannot be replayed
+	_, err = authClient.VerifyTotp(pendingCtx, &auth.VerifyTotpRequest{Code: code})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a replayed code to be rejected with %s, got %v", codes.Unauthenticated, err)
+	}
+
+	verified, err := authClient.VerifyTotp(pendingCtx, &auth.VerifyTotpRequest{Code: recoveryCodes[0]})
+	if err != nil {
+		t.Fatalf("couldn't verify the second factor: %s", err.Error())
+	}
+
+	if verified.State != "authenticated" || verified.RefreshTokenPlaintext == "" {
+		t.Errorf("expected an authenticated login, got %q", verified.State)
+	}
+
+	res, err := authClient.Authenticate(context.Background(), &auth.AuthenticationRequest{
+		TokenScope:     data.ScopeAuthentication,
+		TokenPlaintext: verified.TokenPlaintext,
+	})
+	if err != nil {
+		t.Fatalf("couldn't authenticate the session: %s", err.Error())
+	}
+
+	if res.Acr != "aal2" || !slices.Contains(res.Amr, data.AuthMethodEmail) || !slices.Contains(res.Amr, data.AuthMethodRecoveryCode) {
+		t.Errorf("expected a two factor login, got acr %q amr %v", res.Acr, res.Amr)
+	}
+
+	// the mfa-pending token is spent
+	_, err = authClient.VerifyTotp(pendingCtx, &auth.VerifyTotpRequest{Code: recoveryCodes[1]})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("expected a spent mfa-pending token to be rejected with %s, got %v", codes.Unauthenticated, err)
+	}
+
+	verifiedCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+verified.TokenPlaintext)
+
+	_, err = authClient.DisableTotp(verifiedCtx, &auth.DisableTotpRequest{Code: recoveryCodes[1]})
+	if err != nil {
+		t.Errorf("couldn't disable totp: %s", err.Error())
+	}
+}
+
+func TestTotpLoginExpiredPassword(t *testing.T) {
+	db := openTestDB(t)
+
+	conn, email, notifier := dialLoginCodeTest(t)
+	authClient := auth.NewAuthenticationClient(conn)
+
+	// a password the test knows
+	_, err := authClient.RequestPasswordReset(context.Background(), &auth.RequestPasswordResetRequest{Email: email})
+	if err != nil {
+		t.Fatalf("couldn't request a password reset: %s", err.Error())
+	}
+
+	resetEmail := notifier.waitForEmail(email, 5*time.Second)
+	if resetEmail == nil {
+		t.Fatal("expected a password reset email")
+	}
+
+	password := fmt.Sprintf("pa55word-before-expiry-%d", time.Now().UnixNano())
+
+	_, err = authClient.ResetPassword(context.Background(), &auth.ResetPasswordRequest{
+		TokenPlaintext: resetEmail.Data["passwordResetToken"],
+		NewPassword:    password,
+	})
+	if err != nil {
+		t.Fatalf("couldn't reset password: %s", err.Error())
+	}
+
+	session := loginWithCode(t, conn, email, notifier)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+session.TokenPlaintext)
+
+	_, recoveryCodes := enrollTotp(t, conn, ctx, session.UserId)
+
+	_, err = db.Exec("UPDATE credentials SET password_changed_at = NOW() - INTERVAL '100 years' WHERE user_id = $1", session.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec("UPDATE credentials SET password_changed_at = NOW() WHERE user_id = $1", session.UserId)
+	})
+
+	// the password alone must not get a token that sets a new one
+	pending, err := authClient.Login(context.Background(), &auth.LoginRequest{Email: email, Password: password})
+	if err != nil {
+		t.Fatalf("couldn't log in: %s", err.Error())
+	}
+
+	if pending.State != "mfa_pending" {
+		t.Fatalf("expected an expired password to wait for the second factor, got %q", pending.State)
+	}
+
+	pendingCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+pending.TokenPlaintext)
+
+	verified, err := authClient.VerifyTotp(pendingCtx, &auth.VerifyTotpRequest{Code: recoveryCodes[0]})
+	if err != nil {
+		t.Fatalf("couldn't verify the second factor: %s", err.Error())
+	}
+
+	if verified.State == "authenticated" {
+		t.Skip("-password-max-age is not set")
+	}
+
+	if verified.State != "password_expired" || verified.RefreshTokenPlaintext != "" {
+		t.Fatalf("expected a password-change token after the second factor, got %q", verified.State)
+	}
+
+	changeCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "bearer "+verified.TokenPlaintext)
+
+	_, err = authClient.ChangePassword(changeCtx, &auth.ChangePasswordRequest{
+		CurrentPassword: password,
+		NewPassword:     fmt.Sprintf("pa55word-after-expiry-%d", time.Now().UnixNano()),
+	})
+	if err != nil {
+		t.Errorf("couldn't change the expired password: %s", err.Error())
+	}
+}